@@ -0,0 +1,251 @@
+package idetcd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//advertiseTimeout is how long the command which supplies the advertised addresses may run.
+const advertiseTimeout = 5 * time.Second
+
+//localAddr is an address of a local interface.
+type localAddr struct {
+	iface string
+	ip    net.IP
+}
+
+//addrSelector picks the addresses which current node publishes in its record out of the addresses of the local interfaces.
+type addrSelector struct {
+	//interfaces are the names of the interfaces whose addresses are published, they can be glob patterns like eth*. All the
+	//interfaces which are up and not loopback are used if it is empty.
+	interfaces []string
+	//networks only allows the addresses in them if it is not empty, and the addresses in exclude are never published.
+	networks []*net.IPNet
+	exclude  []*net.IPNet
+	//prefer are the networks whose addresses come first in the record, in the given order.
+	prefer []*net.IPNet
+	//advertise supplies the addresses which are published instead of the ones of the local interfaces, it is nil if the
+	//addresses are not advertised explicitly.
+	advertise *advertiser
+}
+
+//advertiser supplies the addresses which current node advertises, they are read from:
+//ADDRESS...: the literal addresses.
+//env VAR: the environment variable.
+//file PATH: the file.
+//exec COMMAND ARGS...: the output of the command.
+//Several addresses are separated by white spaces or commas.
+type advertiser struct {
+	source string
+	args   []string
+}
+
+//newAdvertiser checks the source of the advertised addresses, the literal addresses are validated right away.
+func newAdvertiser(args []string) (*advertiser, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("advertise needs an address or a source of addresses")
+	}
+	a := &advertiser{source: args[0], args: args[1:]}
+	switch a.source {
+	case "env", "file":
+		if len(a.args) != 1 {
+			return nil, fmt.Errorf("advertise %s takes exactly one argument", a.source)
+		}
+	case "exec":
+		if len(a.args) == 0 {
+			return nil, fmt.Errorf("advertise exec needs a command")
+		}
+	default:
+		a = &advertiser{args: args}
+		if _, err := a.addresses(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+//addresses reads the advertised addresses from the source, it fails if any of them is not a unicast address.
+func (a *advertiser) addresses() ([]net.IP, error) {
+	var text string
+	switch a.source {
+	case "env":
+		value, ok := os.LookupEnv(a.args[0])
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s of the advertised address is not set", a.args[0])
+		}
+		text = value
+	case "file":
+		content, err := ioutil.ReadFile(a.args[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not read the advertised address: %s", err)
+		}
+		text = string(content)
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), advertiseTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, a.args[0], a.args[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("could not run %s for the advertised address: %s", a.args[0], err)
+		}
+		text = string(out)
+	default:
+		text = strings.Join(a.args, " ")
+	}
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no advertised address is found")
+	}
+	var ips []net.IP
+	for _, field := range fields {
+		ip := net.ParseIP(field)
+		if ip == nil || ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return nil, fmt.Errorf("advertised address %q is not a valid unicast address", field)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+//parseNetworks parses the networks in CIDR notation.
+func parseNetworks(args []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, arg := range args {
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", arg)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//localAddrs returns the addresses of the interfaces which are up, in the order of the interfaces.
+func localAddrs() ([]localAddr, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []localAddr
+	for _, inter := range interfaces {
+		if inter.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaddrs, err := inter.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range ifaddrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				addrs = append(addrs, localAddr{iface: inter.Name, ip: ipnet.IP})
+			}
+		}
+	}
+	return addrs, nil
+}
+
+//pick returns the addresses which are selected, in the order of preference: the addresses in the preferred networks come first,
+//then the ones of the interfaces in the given order, and otherwise in the order of the interfaces. Loopback and link-local
+//addresses are never selected, as other nodes can not reach them.
+func (s *addrSelector) pick(addrs []localAddr) []net.IP {
+	type candidate struct {
+		ip          net.IP
+		prefer, pos int
+	}
+	var candidates []candidate
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		ip := addr.ip
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || seen[ip.String()] {
+			continue
+		}
+		pos := matchInterface(s.interfaces, addr.iface)
+		if pos < 0 || (len(s.networks) != 0 && matchNetwork(s.networks, ip) < 0) || matchNetwork(s.exclude, ip) >= 0 {
+			continue
+		}
+		prefer := matchNetwork(s.prefer, ip)
+		if prefer < 0 {
+			prefer = len(s.prefer)
+		}
+		seen[ip.String()] = true
+		candidates = append(candidates, candidate{ip: ip, prefer: prefer, pos: pos})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].prefer != candidates[j].prefer {
+			return candidates[i].prefer < candidates[j].prefer
+		}
+		return candidates[i].pos < candidates[j].pos
+	})
+	ips := make([]net.IP, len(candidates))
+	for i, c := range candidates {
+		ips[i] = c.ip
+	}
+	return ips
+}
+
+//record returns the record with the advertised addresses of current node, or the selected addresses of the local interfaces if
+//they are not advertised explicitly. The first address of every family is also kept in the single address fields, so nodes
+//which only know those can still read the record.
+func (s *addrSelector) record() (Record, error) {
+	var ips []net.IP
+	if s.advertise != nil {
+		advertised, err := s.advertise.addresses()
+		if err != nil {
+			return Record{}, err
+		}
+		ips = advertised
+	} else {
+		addrs, err := localAddrs()
+		if err != nil {
+			return Record{}, err
+		}
+		ips = s.pick(addrs)
+	}
+	var record Record
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			record.Ipv4s = append(record.Ipv4s, ip.String())
+		} else {
+			record.Ipv6s = append(record.Ipv6s, ip.String())
+		}
+	}
+	if len(record.Ipv4s) != 0 {
+		record.Ipv4 = record.Ipv4s[0]
+	}
+	if len(record.Ipv6s) != 0 {
+		record.Ipv6 = record.Ipv6s[0]
+	}
+	return record, nil
+}
+
+//matchInterface returns the position of the first pattern which matches the name of the interface, or -1 if none does. Any
+//interface matches if there is no pattern.
+func matchInterface(patterns []string, name string) int {
+	if len(patterns) == 0 {
+		return 0
+	}
+	for i, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+//matchNetwork returns the position of the first network which contains the ip, or -1 if none does.
+func matchNetwork(networks []*net.IPNet, ip net.IP) int {
+	for i, network := range networks {
+		if network.Contains(ip) {
+			return i
+		}
+	}
+	return -1
+}
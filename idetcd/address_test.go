@@ -0,0 +1,146 @@
+package idetcd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPickAddresses(t *testing.T) {
+	addrs := []localAddr{
+		{"lo", net.ParseIP("127.0.0.1")},
+		{"lo", net.ParseIP("::1")},
+		{"docker0", net.ParseIP("172.17.0.1")},
+		{"eth0", net.ParseIP("10.0.0.1")},
+		{"eth0", net.ParseIP("fe80::1")},
+		{"eth0", net.ParseIP("fd00::1")},
+		{"ib0", net.ParseIP("192.168.0.1")},
+		//The same address on two interfaces.
+		{"ib1", net.ParseIP("192.168.0.1")},
+	}
+	mustParse := func(cidrs ...string) []*net.IPNet {
+		networks, err := parseNetworks(cidrs)
+		if err != nil {
+			t.Fatalf("Could not parse the networks: %s", err)
+		}
+		return networks
+	}
+	tests := []struct {
+		selector addrSelector
+		expected []string
+	}{
+		//Every address which other nodes can reach is picked by default.
+		{addrSelector{}, []string{"172.17.0.1", "10.0.0.1", "fd00::1", "192.168.0.1"}},
+		//The interfaces are picked by name or pattern, and their addresses come in the given order.
+		{addrSelector{interfaces: []string{"ib*", "eth0"}}, []string{"192.168.0.1", "10.0.0.1", "fd00::1"}},
+		{addrSelector{networks: mustParse("10.0.0.0/8", "fd00::/8")}, []string{"10.0.0.1", "fd00::1"}},
+		{addrSelector{exclude: mustParse("172.17.0.0/16")}, []string{"10.0.0.1", "fd00::1", "192.168.0.1"}},
+		{addrSelector{prefer: mustParse("192.168.0.0/16", "10.0.0.0/8")}, []string{"192.168.0.1", "10.0.0.1", "172.17.0.1", "fd00::1"}},
+		{addrSelector{interfaces: []string{"wlan0"}}, nil},
+	}
+	for i, tc := range tests {
+		var picked []string
+		for _, ip := range tc.selector.pick(addrs) {
+			picked = append(picked, ip.String())
+		}
+		if !reflect.DeepEqual(picked, tc.expected) {
+			t.Errorf("Test %d: Expected addresses %v, got: %v", i, tc.expected, picked)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	if _, err := parseNetworks([]string{"10.0.0.0/8", "fd00::/8"}); err != nil {
+		t.Errorf("Expected no error but found one: %s", err)
+	}
+	if _, err := parseNetworks([]string{"10.0.0.1"}); err == nil {
+		t.Errorf("Expected an error for an address without prefix length")
+	}
+}
+
+func TestAdvertise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idetcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "address")
+	if err := ioutil.WriteFile(path, []byte("203.0.113.7\n2001:db8::7\n"), 0644); err != nil {
+		t.Fatalf("Could not write the address file: %s", err)
+	}
+	os.Setenv("IDETCD_TEST_ADVERTISE", "203.0.113.8,203.0.113.9")
+	defer os.Unsetenv("IDETCD_TEST_ADVERTISE")
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"203.0.113.7", "2001:db8::7"}, []string{"203.0.113.7", "2001:db8::7"}},
+		{[]string{"env", "IDETCD_TEST_ADVERTISE"}, []string{"203.0.113.8", "203.0.113.9"}},
+		{[]string{"file", path}, []string{"203.0.113.7", "2001:db8::7"}},
+		{[]string{"exec", "echo", "203.0.113.10"}, []string{"203.0.113.10"}},
+	}
+	for i, tc := range tests {
+		a, err := newAdvertiser(tc.args)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error but found one: %s", i, err)
+		}
+		ips, err := a.addresses()
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error but found one: %s", i, err)
+		}
+		var advertised []string
+		for _, ip := range ips {
+			advertised = append(advertised, ip.String())
+		}
+		if !reflect.DeepEqual(advertised, tc.expected) {
+			t.Errorf("Test %d: Expected addresses %v, got: %v", i, tc.expected, advertised)
+		}
+	}
+
+	//The advertised addresses replace the ones of the local interfaces.
+	a, _ := newAdvertiser([]string{"203.0.113.7", "2001:db8::7", "203.0.113.8"})
+	record, err := (&addrSelector{advertise: a}).record()
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if record.Ipv4 != "203.0.113.7" || record.Ipv6 != "2001:db8::7" || len(record.Ipv4s) != 2 || len(record.Ipv6s) != 1 {
+		t.Errorf("Expected the record with the advertised addresses, got: %+v", record)
+	}
+}
+
+func TestAdvertiseInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"not-an-ip"},
+		{"0.0.0.0"},
+		{"::"},
+		{"224.0.0.1"},
+		{"255.255.255.255"},
+		{"env"},
+		{"file", "a", "b"},
+		{"exec"},
+	} {
+		if _, err := newAdvertiser(args); err == nil {
+			t.Errorf("Expected an error for advertise %v", args)
+		}
+	}
+	os.Unsetenv("IDETCD_TEST_UNSET")
+	for _, args := range [][]string{
+		{"env", "IDETCD_TEST_UNSET"},
+		{"file", "/nonexistent/idetcd/address"},
+		{"exec", "false"},
+		{"exec", "echo", "ff02::1"},
+	} {
+		a, err := newAdvertiser(args)
+		if err != nil {
+			t.Fatalf("Expected no error for advertise %v but found one: %s", args, err)
+		}
+		if _, err := a.addresses(); err == nil {
+			t.Errorf("Expected an error for the addresses of advertise %v", args)
+		}
+	}
+}
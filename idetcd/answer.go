@@ -0,0 +1,232 @@
+package idetcd
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	//membersLabel is the label of the name which enumerates all the members in a zone, e.g. _members.tf.local.
+	membersLabel = "_members"
+	//staleTTL is the maximum ttl of the answers which are served from stale records while etcd is unreachable.
+	staleTTL = 5
+)
+
+//slotName returns the domain name of the slot which the name belongs to, and whether the name is a service name of the slot,
+//e.g. _grpc._tcp.worker3.tf.local. is a service name of worker3.tf.local.
+func slotName(name string) (string, bool) {
+	idx := dns.Split(name)
+	if len(idx) > 2 && name[idx[0]] == '_' && name[idx[1]] == '_' {
+		return name[idx[2]:], true
+	}
+	return name, false
+}
+
+//addresses returns the RRset of the given type with all the addresses in the record of a slot in the order of preference, it is
+//empty if the node does not have an address of that family.
+func addresses(name string, qtype uint16, class uint16, record *Record) []dns.RR {
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: class}
+	var rrs []dns.RR
+	switch qtype {
+	case dns.TypeA:
+		for _, ip := range record.ipv4s() {
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range record.ipv6s() {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	//The addresses in a record may be advertised twice, but an RRset has no duplicates.
+	return dns.Dedup(rrs, nil)
+}
+
+//srv returns the SRV record of a service name which points to the slot with the port in its record, and the addresses of the
+//slot as glue. Both are empty if the query is not for SRV or the node does not advertise a port.
+func srv(state request.Request, target string, record *Record) ([]dns.RR, []dns.RR) {
+	if state.QType() != dns.TypeSRV {
+		return nil, nil
+	}
+	port, err := strconv.ParseUint(record.Port, 10, 16)
+	if err != nil || port == 0 {
+		return nil, nil
+	}
+	answer := &dns.SRV{
+		Hdr:    dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeSRV, Class: state.QClass()},
+		Port:   uint16(port),
+		Target: target,
+	}
+	extra := append(addresses(target, dns.TypeA, state.QClass(), record), addresses(target, dns.TypeAAAA, state.QClass(), record)...)
+	return []dns.RR{answer}, extra
+}
+
+//lookup answers the query for a name of a slot or a service name of a slot in the zone. It answers NXDOMAIN if the slot is not
+//taken by any node, or the name is not a name of any slot.
+func (idetcd *Idetcd) lookup(state request.Request, m *dns.Msg) error {
+	name, service := slotName(state.Name())
+	var (
+		key    string
+		record *Record
+	)
+	if r, id, ok := idetcd.slotOf(name); ok {
+		var err error
+		key = r.slotKey(id)
+		if record, err = idetcd.store.record(key); err != nil {
+			return err
+		}
+	}
+	switch {
+	case record != nil && service:
+		m.Answer, m.Extra = srv(state, name, record)
+	case record != nil:
+		m.Answer = addresses(state.QName(), state.QType(), state.QClass(), record)
+	default:
+		m.Rcode = dns.RcodeNameError
+		return nil
+	}
+	setTTL(m, idetcd.ttlOf(key))
+	return nil
+}
+
+//members answers the query for the enumeration name of the zone with the records of all the claimed slots in the zone. SRV
+//queries get an SRV record for every slot with its addresses as glue, and A or AAAA queries get the addresses of all the slots,
+//the addresses shared by several slots, e.g. on the same host, are only answered once.
+func (idetcd *Idetcd) members(state request.Request, zone string, m *dns.Msg) error {
+	ttl := idetcd.answerTTL
+	defer func() {
+		m.Answer = dns.Dedup(m.Answer, nil)
+		setTTL(m, ttl)
+	}()
+	return idetcd.eachMember(zone, func(name string, key string, record *Record) {
+		ttl = minTTL(ttl, idetcd.ttlOf(key))
+		switch state.QType() {
+		case dns.TypeSRV:
+			answer, glue := srv(state, name, record)
+			m.Answer = append(m.Answer, answer...)
+			m.Extra = append(m.Extra, glue...)
+		default:
+			m.Answer = append(m.Answer, addresses(state.QName(), state.QType(), state.QClass(), record)...)
+		}
+	})
+}
+
+//apex answers the query for the zone itself: SOA queries get the SOA record of the zone, and NS queries get an NS record for
+//every claimed slot in the zone with its addresses as glue, as every member is a name server of the zone.
+func (idetcd *Idetcd) apex(state request.Request, zone string, m *dns.Msg) error {
+	switch state.QType() {
+	case dns.TypeSOA:
+		soa, err := idetcd.soa(zone)
+		if err != nil {
+			return err
+		}
+		m.Answer = []dns.RR{soa}
+	case dns.TypeNS:
+		ttl := idetcd.answerTTL
+		defer func() { setTTL(m, ttl) }()
+		return idetcd.eachMember(zone, func(name string, key string, record *Record) {
+			ttl = minTTL(ttl, idetcd.ttlOf(key))
+			ns := &dns.NS{Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeNS, Class: state.QClass()}, Ns: name}
+			m.Answer = append(m.Answer, ns)
+			m.Extra = append(m.Extra, addresses(name, dns.TypeA, state.QClass(), record)...)
+			m.Extra = append(m.Extra, addresses(name, dns.TypeAAAA, state.QClass(), record)...)
+		})
+	}
+	return nil
+}
+
+//ptr answers the PTR query for the reverse name of the address with the names of all the slots whose records have the address.
+func (idetcd *Idetcd) ptr(state request.Request, addr string, m *dns.Msg) error {
+	keys, err := idetcd.store.keysOf(addr)
+	if err != nil {
+		return err
+	}
+	var names []string
+	ttl := idetcd.answerTTL
+	for _, key := range keys {
+		if name, ok := idetcd.nameOf(key); ok {
+			names = append(names, name)
+			ttl = minTTL(ttl, idetcd.ttlOf(key))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.Answer = append(m.Answer, &dns.PTR{Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypePTR, Class: state.QClass()}, Ptr: name})
+	}
+	setTTL(m, ttl)
+	return nil
+}
+
+//eachMember calls fn with the domain name, the key and the record of every claimed slot of the roles in the zone, in the order of the
+//roles and the ids. The records of a role are read with a single prefix query.
+func (idetcd *Idetcd) eachMember(zone string, fn func(name string, key string, record *Record)) error {
+	for _, r := range idetcd.roles {
+		if idetcd.zone(r.currentPattern().zone) != zone {
+			continue
+		}
+		records, err := idetcd.store.records(r.slotPrefix())
+		if err != nil {
+			return err
+		}
+		ids := make([]int, 0, len(records))
+		for key := range records {
+			if id, err := strconv.Atoi(strings.TrimPrefix(key, r.slotPrefix())); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			name, err := r.domainName(id)
+			if err != nil {
+				return err
+			}
+			fn(name, r.slotKey(id), records[r.slotKey(id)])
+		}
+	}
+	return nil
+}
+
+//ttlOf returns the ttl of the answers from the record saved in the key, which is the answer ttl capped by the remaining time of
+//the lease of the record, so resolvers do not cache the record for longer than its owner may be alive.
+func (idetcd *Idetcd) ttlOf(key string) uint32 {
+	ttl := idetcd.answerTTL
+	remaining, ok := idetcd.store.remaining(key)
+	if !ok {
+		return ttl
+	}
+	if remaining <= 0 {
+		return 0
+	}
+	return minTTL(ttl, uint32(remaining/time.Second))
+}
+
+func minTTL(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//setTTL sets the ttl of all the records in the answer and additional sections of the message.
+func setTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Extra} {
+		for _, rr := range section {
+			rr.Header().Ttl = ttl
+		}
+	}
+}
+
+//capTTL caps the ttl of all the records in the message.
+func capTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
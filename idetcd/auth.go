@@ -0,0 +1,53 @@
+package idetcd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+//credentials returns the username and the password which current node authenticates to etcd with, they can be read from:
+//USERNAME PASSWORD: the Corefile.
+//env VAR: the environment variable, in the form of USERNAME:PASSWORD.
+//file PATH: the file, in the form of USERNAME:PASSWORD.
+func credentials(args []string) (string, string, error) {
+	var text string
+	switch {
+	case len(args) == 2 && args[0] == "env":
+		value, ok := os.LookupEnv(args[1])
+		if !ok {
+			return "", "", fmt.Errorf("environment variable %s of the credentials is not set", args[1])
+		}
+		text = value
+	case len(args) == 2 && args[0] == "file":
+		content, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return "", "", fmt.Errorf("could not read the credentials: %s", err)
+		}
+		text = string(content)
+	case len(args) == 2:
+		text = args[0] + ":" + args[1]
+	default:
+		return "", "", fmt.Errorf("credentials takes a username and a password, env VAR or file PATH")
+	}
+	parts := strings.SplitN(strings.TrimSpace(text), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("credentials should be in the form of USERNAME:PASSWORD")
+	}
+	return parts[0], parts[1], nil
+}
+
+//authError explains the errors of etcd which are caused by the credentials or the permissions of current node, as they are
+//not solved by retrying. Other errors are returned as they are.
+func authError(err error) error {
+	switch err {
+	case rpctypes.ErrAuthFailed, rpctypes.ErrUserEmpty, rpctypes.ErrInvalidAuthToken:
+		return fmt.Errorf("etcd could not authenticate idetcd, check the credentials: %s", err)
+	case rpctypes.ErrPermissionDenied, rpctypes.ErrRoleNotGranted:
+		return fmt.Errorf("etcd denied the access of idetcd, check the role of the user: %s", err)
+	}
+	return err
+}
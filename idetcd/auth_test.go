@@ -0,0 +1,139 @@
+package idetcd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/mholt/caddy"
+)
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idetcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(path, []byte("idetcd:secret:with:colons\n"), 0600); err != nil {
+		t.Fatalf("Could not write the credentials: %s", err)
+	}
+	os.Setenv("IDETCD_TEST_CREDENTIALS", "idetcd:secret")
+	defer os.Unsetenv("IDETCD_TEST_CREDENTIALS")
+
+	tests := []struct {
+		args      []string
+		shouldErr bool
+		username  string
+		password  string
+	}{
+		{[]string{"idetcd", "secret"}, false, "idetcd", "secret"},
+		{[]string{"env", "IDETCD_TEST_CREDENTIALS"}, false, "idetcd", "secret"},
+		{[]string{"file", path}, false, "idetcd", "secret:with:colons"},
+		{[]string{"env", "IDETCD_TEST_UNSET"}, true, "", ""},
+		{[]string{"file", filepath.Join(dir, "missing")}, true, "", ""},
+		{[]string{"idetcd"}, true, "", ""},
+		{[]string{"idetcd", ""}, true, "", ""},
+	}
+	for i, tc := range tests {
+		username, password, err := credentials(tc.args)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error but found none", i)
+			}
+			continue
+		}
+		if err != nil || username != tc.username || password != tc.password {
+			t.Errorf("Test %d: Expected %s:%s, got: %s:%s, %v", i, tc.username, tc.password, username, password, err)
+		}
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	for _, err := range []error{rpctypes.ErrAuthFailed, rpctypes.ErrPermissionDenied} {
+		if explained := authError(err); explained == err || !strings.Contains(explained.Error(), err.Error()) {
+			t.Errorf("Expected %s to be explained, got: %s", err, explained)
+		}
+	}
+	if err := authError(rpctypes.ErrLeaseNotFound); err != rpctypes.ErrLeaseNotFound {
+		t.Errorf("Expected other errors to be returned as they are, got: %s", err)
+	}
+	if err := authError(nil); err != nil {
+		t.Errorf("Expected no error, got: %s", err)
+	}
+}
+
+//TestAuthEnabledEtcd enables the authentication of an embedded etcd, and checks that idetcd can claim a slot with a
+//user which only has the minimal role, and that it fails clearly with wrong credentials or without permission.
+func TestAuthEnabledEtcd(t *testing.T) {
+	endpoint, stop := startEtcd(t, nil)
+	defer stop()
+	ctx := context.Background()
+	root, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}})
+	if err != nil {
+		t.Fatalf("Could not create the etcd client: %s", err)
+	}
+	defer root.Close()
+	for _, step := range []func() error{
+		func() error { _, err := root.UserAdd(ctx, "root", "rootpw"); return err },
+		func() error { _, err := root.UserGrantRole(ctx, "root", "root"); return err },
+		func() error { _, err := root.RoleAdd(ctx, "idetcd"); return err },
+		func() error {
+			_, err := root.RoleGrantPermission(ctx, "idetcd", "/idetcd/", clientv3.GetPrefixRangeEnd("/idetcd/"),
+				clientv3.PermissionType(clientv3.PermReadWrite))
+			return err
+		},
+		func() error { _, err := root.UserAdd(ctx, "idetcd", "secret"); return err },
+		func() error { _, err := root.UserGrantRole(ctx, "idetcd", "idetcd"); return err },
+		func() error { _, err := root.UserAdd(ctx, "nobody", "secret"); return err },
+		func() error { _, err := root.AuthEnable(ctx); return err },
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("Could not set up the authentication: %s", err)
+		}
+	}
+	connect := func(credentials string) (*Idetcd, error) {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+				endpoint `+endpoint+`
+				pattern worker{{.ID}}.tf.local.
+				credentials `+credentials+`
+			}`))
+		if err != nil {
+			return nil, err
+		}
+		return idetc, idetc.connect()
+	}
+	idetc, err := connect("idetcd secret")
+	if err != nil {
+		t.Fatalf("Could not connect with the credentials: %s", err)
+	}
+	defer idetc.Client.Close()
+	lease, err := idetc.grant()
+	if err != nil {
+		t.Fatalf("Could not grant the lease: %s", err)
+	}
+	idetc.lease = lease.ID
+	if name, err := idetc.claimSlot("value", idetc.lease); err != nil || name != "worker1.tf.local." {
+		t.Errorf("Expected to claim worker1.tf.local. with the minimal role, got: %s, %v", name, err)
+	}
+	if err := idetc.release(); err != nil {
+		t.Errorf("Could not release the slot with the minimal role: %s", err)
+	}
+
+	if _, err := connect("idetcd wrong"); err == nil || !strings.Contains(err.Error(), "check the credentials") {
+		t.Errorf("Expected the wrong password to be explained, got: %v", err)
+	}
+	nobody, err := connect("nobody secret")
+	if err != nil {
+		t.Fatalf("Could not connect with the credentials: %s", err)
+	}
+	defer nobody.Client.Close()
+	if _, err := nobody.claimSlot("value", 0); err == nil || !strings.Contains(err.Error(), "check the role") {
+		t.Errorf("Expected the missing permission to be explained, got: %v", err)
+	}
+}
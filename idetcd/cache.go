@@ -0,0 +1,292 @@
+package idetcd
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+)
+
+//recordCache is a store which keeps the records of all the slots in memory, so ServeDNS does not read the etcd on every query.
+//It is filled by a prefix query on the slots of every role, and kept current by watching them.
+type recordCache struct {
+	idetcd *Idetcd
+	mu     sync.RWMutex
+	data   map[string]*Record
+	//keys indexes the keys of the records by their addresses, an address may be in the records of several slots.
+	keys map[string]map[string]bool
+	//filled keeps the slot prefixes of the roles whose records have been read at least once.
+	filled map[string]bool
+	//lost is the time since when etcd has been unreachable, it is zero while etcd is reachable.
+	lost time.Time
+	//revs keeps the etcd revision of the last change seen under every slot prefix, it never decreases.
+	revs map[string]int64
+	//leases keeps the lease which every record is attached to, and expiry keeps when the leases expire as of the last time they
+	//were read. A lease which has not been read yet has no expiry.
+	leases map[string]etcdcv3.LeaseID
+	expiry map[etcdcv3.LeaseID]time.Time
+}
+
+func newRecordCache(idetcd *Idetcd) *recordCache {
+	return &recordCache{
+		idetcd: idetcd,
+		data:   make(map[string]*Record),
+		keys:   make(map[string]map[string]bool),
+		leases: make(map[string]etcdcv3.LeaseID),
+		expiry: make(map[etcdcv3.LeaseID]time.Time),
+		revs:   make(map[string]int64),
+		filled: make(map[string]bool),
+	}
+}
+
+func (c *recordCache) record(key string) (*Record, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data[key], nil
+}
+
+func (c *recordCache) records(prefix string) (map[string]*Record, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	records := make(map[string]*Record)
+	for key, record := range c.data {
+		if strings.HasPrefix(key, prefix) {
+			records[key] = record
+		}
+	}
+	return records, nil
+}
+
+func (c *recordCache) keysOf(addr string) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var keys []string
+	for key := range c.keys[addr] {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (c *recordCache) loaded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.filled) == len(c.idetcd.roles)
+}
+
+func (c *recordCache) staleness() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lost.IsZero() {
+		return 0
+	}
+	return time.Since(c.lost)
+}
+
+func (c *recordCache) remaining(key string) (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	lease, ok := c.leases[key]
+	if !ok {
+		return 0, false
+	}
+	//The record may disappear at any time until its lease has been read.
+	expiry, ok := c.expiry[lease]
+	if !ok {
+		return 0, true
+	}
+	return time.Until(expiry), true
+}
+
+func (c *recordCache) revision(prefix string) (int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.revs[prefix], nil
+}
+
+//advance records that the records under the prefix are current as of the revision, c.mu should be held for writing.
+func (c *recordCache) advance(prefix string, rev int64) {
+	if rev > c.revs[prefix] {
+		c.revs[prefix] = rev
+	}
+}
+
+//reachable records whether etcd is reachable according to the result of a request, the records in memory are stale while
+//etcd is unreachable, as the changes can not be watched.
+func (c *recordCache) reachable(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err != nil && c.lost.IsZero():
+		log.Warningf("etcd is unreachable, the records in memory may be stale: %s", err)
+		c.lost = time.Now()
+	case err == nil && !c.lost.IsZero():
+		log.Infof("etcd is reachable again after %s", time.Since(c.lost))
+		c.lost = time.Time{}
+	}
+	if !c.lost.IsZero() {
+		staleSeconds.Set(time.Since(c.lost).Seconds())
+	} else {
+		staleSeconds.Set(0)
+	}
+}
+
+//probe checks whether etcd is reachable and reads when the leases of the records expire every renewal interval until ctx is done.
+func (c *recordCache) probe(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.idetcd.renewInterval()):
+		}
+		_, err := c.idetcd.get(c.idetcd.roles[0].slotPrefix(), etcdcv3.WithPrefix(), etcdcv3.WithCountOnly())
+		if ctx.Err() == nil {
+			c.reachable(err)
+		}
+		if err == nil {
+			c.refreshLeases(true)
+		}
+	}
+}
+
+//refreshLeases reads when the leases which the records are attached to expire, with a single request for every lease however
+//many records are attached to it. Only the leases which have not been read yet are read unless all is set, and the leases which
+//no record is attached to any more are forgotten.
+func (c *recordCache) refreshLeases(all bool) {
+	c.mu.RLock()
+	leases := make(map[etcdcv3.LeaseID]bool)
+	for _, lease := range c.leases {
+		if _, ok := c.expiry[lease]; all || !ok {
+			leases[lease] = true
+		}
+	}
+	c.mu.RUnlock()
+	expiry := make(map[etcdcv3.LeaseID]time.Time, len(leases))
+	for lease := range leases {
+		ctx, cancel := context.WithTimeout(c.idetcd.Ctx, c.idetcd.timeout)
+		resp, err := c.idetcd.Client.TimeToLive(ctx, lease)
+		cancel()
+		if err != nil {
+			continue
+		}
+		//The ttl is -1 if the lease has expired already.
+		expiry[lease] = time.Now().Add(time.Duration(resp.TTL) * time.Second)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for lease, at := range expiry {
+		c.expiry[lease] = at
+	}
+	attached := make(map[etcdcv3.LeaseID]bool, len(c.leases))
+	for _, lease := range c.leases {
+		attached[lease] = true
+	}
+	for lease := range c.expiry {
+		if !attached[lease] {
+			delete(c.expiry, lease)
+		}
+	}
+}
+
+//load reads all the records of the role with a single prefix query and replaces the ones in the cache, it returns the revision
+//of the read.
+func (c *recordCache) load(r *role) (int64, error) {
+	resp, err := c.idetcd.get(r.slotPrefix(), etcdcv3.WithPrefix())
+	c.reachable(err)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	for key := range c.data {
+		if strings.HasPrefix(key, r.slotPrefix()) {
+			c.remove(key)
+		}
+	}
+	for _, kv := range resp.Kvs {
+		c.put(kv.Key, kv.Value, kv.Lease)
+	}
+	c.advance(r.slotPrefix(), resp.Header.Revision)
+	c.filled[r.slotPrefix()] = true
+	c.mu.Unlock()
+	c.refreshLeases(false)
+	return resp.Header.Revision, nil
+}
+
+//watch keeps the records of the role in the cache current until ctx is done. All the records of the role are read again if the
+//watch is canceled, e.g. the revision has been compacted.
+func (c *recordCache) watch(ctx context.Context, r *role, rev int64) {
+	for ctx.Err() == nil {
+		for resp := range c.idetcd.Client.Watch(ctx, r.slotPrefix(), etcdcv3.WithPrefix(), etcdcv3.WithRev(rev+1)) {
+			if resp.Err() != nil {
+				log.Warningf("Watch of the records in %s is canceled: %s", r.slotPrefix(), resp.Err())
+				break
+			}
+			c.reachable(nil)
+			c.mu.Lock()
+			for _, ev := range resp.Events {
+				if ev.Type == etcdcv3.EventTypeDelete {
+					c.remove(string(ev.Kv.Key))
+				} else {
+					c.put(ev.Kv.Key, ev.Kv.Value, ev.Kv.Lease)
+				}
+				//The revision of a delete event is the revision of the delete, so members leaving change it as well.
+				c.advance(r.slotPrefix(), ev.Kv.ModRevision)
+				rev = ev.Kv.ModRevision
+			}
+			c.mu.Unlock()
+			//The records put by the nodes which have just joined are answered with ttl 0 until their leases are read.
+			c.refreshLeases(false)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		current, err := c.load(r)
+		if err != nil {
+			log.Errorf("Could not read the records in %s: %s", r.slotPrefix(), err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.idetcd.timeout):
+			}
+			continue
+		}
+		rev = current
+	}
+}
+
+//put saves the record attached to the lease in the cache and indexes it by its addresses, c.mu should be held for writing.
+func (c *recordCache) put(key []byte, value []byte, lease int64) {
+	c.remove(string(key))
+	record := new(Record)
+	if err := json.Unmarshal(value, record); err != nil {
+		log.Warningf("Invalid record in %s: %s", key, err)
+		return
+	}
+	c.data[string(key)] = record
+	if lease != 0 {
+		c.leases[string(key)] = etcdcv3.LeaseID(lease)
+	}
+	for _, addr := range record.addresses() {
+		if c.keys[addr] == nil {
+			c.keys[addr] = make(map[string]bool)
+		}
+		c.keys[addr][string(key)] = true
+	}
+}
+
+//remove deletes the record from the cache and its addresses from the index, c.mu should be held for writing.
+func (c *recordCache) remove(key string) {
+	record, ok := c.data[key]
+	if !ok {
+		return
+	}
+	delete(c.data, key)
+	delete(c.leases, key)
+	for _, addr := range record.addresses() {
+		delete(c.keys[addr], key)
+		if len(c.keys[addr]) == 0 {
+			delete(c.keys, addr)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package idetcd
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func newCacheIdetcd(t testing.TB) *Idetcd {
+	idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit 100
+		}`))
+	if err != nil {
+		t.Fatalf("Could not parse the corefile: %s", err)
+	}
+	if err := idetc.connect(); err != nil {
+		t.Fatalf("Could not connect to etcd: %s", err)
+	}
+	return idetc
+}
+
+func TestRecordCacheFollowsEtcd(t *testing.T) {
+	idetc := newCacheIdetcd(t)
+	defer idetc.Client.Close()
+	r := idetc.roles[0]
+	cache := newRecordCache(idetc)
+	if cache.loaded() {
+		t.Fatalf("Expected the cache not to be loaded before the records are read")
+	}
+	rev, err := cache.load(r)
+	if err != nil {
+		t.Fatalf("Could not load the records: %s", err)
+	}
+	if !cache.loaded() {
+		t.Fatalf("Expected the cache to be loaded once the records are read")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.watch(ctx, r, rev)
+
+	idetc.set(r.slotKey(1), `{"ipv4":"10.0.0.1"}`)
+	waitCache(t, cache, r.slotKey(1), true)
+	joined, _ := cache.revision(r.slotPrefix())
+	if joined <= rev {
+		t.Errorf("Expected the revision to grow after %d once a member joins, got: %d", rev, joined)
+	}
+	idetc.del(r.slotKey(1))
+	waitCache(t, cache, r.slotKey(1), false)
+	if left, _ := cache.revision(r.slotPrefix()); left <= joined {
+		t.Errorf("Expected the revision to grow after %d once a member leaves, got: %d", joined, left)
+	}
+	deleteAll()
+}
+
+func TestRecordCacheResyncAfterCompaction(t *testing.T) {
+	idetc := newCacheIdetcd(t)
+	defer idetc.Client.Close()
+	r := idetc.roles[0]
+	cache := newRecordCache(idetc)
+	rev, err := cache.load(r)
+	if err != nil {
+		t.Fatalf("Could not load the records: %s", err)
+	}
+	idetc.set(r.slotKey(1), `{"ipv4":"10.0.0.1"}`)
+	resp, err := idetc.set(r.slotKey(2), `{"ipv4":"10.0.0.2"}`)
+	if err != nil {
+		t.Fatalf("Could not put the record: %s", err)
+	}
+	if _, err := idetc.Client.Compact(context.Background(), resp.Header.Revision); err != nil {
+		t.Fatalf("Could not compact: %s", err)
+	}
+
+	//The watch starts from a compacted revision, so it is canceled and the cache reads all the records again.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.watch(ctx, r, rev)
+	waitCache(t, cache, r.slotKey(1), true)
+	waitCache(t, cache, r.slotKey(2), true)
+	deleteAll()
+}
+
+func TestRecordCacheStaleness(t *testing.T) {
+	cache := newRecordCache(&Idetcd{})
+	if stale := cache.staleness(); stale != 0 {
+		t.Fatalf("Expected the records to be current, got staleness %s", stale)
+	}
+	cache.reachable(errors.New("etcd is down"))
+	time.Sleep(10 * time.Millisecond)
+	first := cache.staleness()
+	if first <= 0 {
+		t.Fatalf("Expected the records to be stale once etcd is unreachable")
+	}
+	//Staleness is counted from the first failure.
+	cache.reachable(errors.New("etcd is down"))
+	if stale := cache.staleness(); stale < first {
+		t.Errorf("Expected the staleness to keep growing, got %s after %s", stale, first)
+	}
+	cache.reachable(nil)
+	if stale := cache.staleness(); stale != 0 {
+		t.Errorf("Expected the records to be current once etcd is reachable, got staleness %s", stale)
+	}
+}
+
+func TestRecordCacheIndex(t *testing.T) {
+	cache := newRecordCache(&Idetcd{})
+	cache.put([]byte("/idetcd/worker*.tf.local./slots/1"), []byte(`{"ipv4":"10.0.0.1","ipv6":"fd00:0::1"}`), 0)
+	cache.put([]byte("/idetcd/worker*.tf.local./slots/2"), []byte(`{"ipv4":"10.0.0.1"}`), 0)
+	if keys, _ := cache.keysOf("10.0.0.1"); len(keys) != 2 {
+		t.Errorf("Expected two records with 10.0.0.1, got: %v", keys)
+	}
+	if keys, _ := cache.keysOf("fd00::1"); len(keys) != 1 {
+		t.Errorf("Expected one record with fd00::1, got: %v", keys)
+	}
+
+	//The index follows the changes of the records.
+	cache.put([]byte("/idetcd/worker*.tf.local./slots/1"), []byte(`{"ipv4":"10.0.0.3"}`), 0)
+	if keys, _ := cache.keysOf("fd00::1"); len(keys) != 0 {
+		t.Errorf("Expected no record with fd00::1, got: %v", keys)
+	}
+	cache.remove("/idetcd/worker*.tf.local./slots/2")
+	if keys, _ := cache.keysOf("10.0.0.1"); len(keys) != 0 {
+		t.Errorf("Expected no record with 10.0.0.1, got: %v", keys)
+	}
+	if keys, _ := cache.keysOf("10.0.0.3"); len(keys) != 1 {
+		t.Errorf("Expected one record with 10.0.0.3, got: %v", keys)
+	}
+}
+
+func TestRecordCacheRevision(t *testing.T) {
+	cache := newRecordCache(&Idetcd{})
+	cache.advance("/idetcd/worker*.tf.local./slots/", 5)
+	cache.advance("/idetcd/ps*.tf.local./slots/", 9)
+	//Only the changes under the prefix count, however late the other records were changed.
+	if rev, _ := cache.revision("/idetcd/worker*.tf.local./slots/"); rev != 5 {
+		t.Errorf("Expected the revision 5, got: %d", rev)
+	}
+	//A member leaving is a change as well, and the revision never goes back.
+	cache.advance("/idetcd/worker*.tf.local./slots/", 7)
+	cache.advance("/idetcd/worker*.tf.local./slots/", 6)
+	if rev, _ := cache.revision("/idetcd/worker*.tf.local./slots/"); rev != 7 {
+		t.Errorf("Expected the revision 7, got: %d", rev)
+	}
+	if rev, _ := cache.revision("/idetcd/db*.tf.local./slots/"); rev != 0 {
+		t.Errorf("Expected the revision 0 without records, got: %d", rev)
+	}
+}
+
+func TestRecordCacheRemaining(t *testing.T) {
+	cache := newRecordCache(&Idetcd{})
+	cache.put([]byte("/idetcd/worker*.tf.local./slots/1"), []byte(`{"ipv4":"10.0.0.1"}`), 1)
+	cache.put([]byte("/idetcd/worker*.tf.local./slots/2"), []byte(`{"ipv4":"10.0.0.2"}`), 0)
+	cache.put([]byte("/idetcd/worker*.tf.local./slots/3"), []byte(`{"ipv4":"10.0.0.3"}`), 3)
+	cache.expiry[1] = time.Now().Add(10 * time.Second)
+	//The record lives as long as its lease, however the node which reads it is configured.
+	if remaining, ok := cache.remaining("/idetcd/worker*.tf.local./slots/1"); !ok || remaining <= 9*time.Second || remaining > 10*time.Second {
+		t.Errorf("Expected the record to live for 10s, got: %s, %t", remaining, ok)
+	}
+	if _, ok := cache.remaining("/idetcd/worker*.tf.local./slots/2"); ok {
+		t.Errorf("Expected the record without a lease to have no remaining time")
+	}
+	if remaining, ok := cache.remaining("/idetcd/worker*.tf.local./slots/3"); !ok || remaining != 0 {
+		t.Errorf("Expected the record whose lease has not been read to have no time left, got: %s, %t", remaining, ok)
+	}
+	cache.remove("/idetcd/worker*.tf.local./slots/1")
+	if _, ok := cache.remaining("/idetcd/worker*.tf.local./slots/1"); ok {
+		t.Errorf("Expected the removed record to have no remaining time")
+	}
+}
+
+//TestRecordCacheLeases checks that the remaining time of a record follows its lease in the etcd, and that a lease which stops
+//being renewed is not extended.
+func TestRecordCacheLeases(t *testing.T) {
+	idetc := newCacheIdetcd(t)
+	defer idetc.Client.Close()
+	r := idetc.roles[0]
+	lease, err := idetc.Client.Grant(context.Background(), 30)
+	if err != nil {
+		t.Fatalf("Could not grant the lease: %s", err)
+	}
+	for id := 1; id <= 2; id++ {
+		if _, err := idetc.Client.Put(context.Background(), r.slotKey(id), `{"ipv4":"10.0.0.1"}`, clientv3.WithLease(lease.ID)); err != nil {
+			t.Fatalf("Could not put the record: %s", err)
+		}
+	}
+	cache := newRecordCache(idetc)
+	if _, err := cache.load(r); err != nil {
+		t.Fatalf("Could not load the records: %s", err)
+	}
+	for id := 1; id <= 2; id++ {
+		if remaining, ok := cache.remaining(r.slotKey(id)); !ok || remaining <= 25*time.Second || remaining > 30*time.Second {
+			t.Errorf("Expected the record of slot %d to live for about 30s, got: %s, %t", id, remaining, ok)
+		}
+	}
+	time.Sleep(2 * time.Second)
+	cache.refreshLeases(true)
+	if remaining, _ := cache.remaining(r.slotKey(1)); remaining > 28*time.Second {
+		t.Errorf("Expected the lease which is not renewed to run down, got: %s", remaining)
+	}
+	deleteAll()
+}
+
+//waitCache waits until the record of the key is in the cache or not.
+func waitCache(t *testing.T, cache *recordCache, key string, exists bool) {
+	for i := 0; i < 50; i++ {
+		if record, _ := cache.record(key); (record != nil) == exists {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Expected the record of %s in the cache to be %t", key, exists)
+}
+
+//benchmarkServeDNS queries the A records of the slots through ServeDNS with the store, and reports the p99 latency of the queries.
+func benchmarkServeDNS(b *testing.B, idetc *Idetcd) {
+	r := idetc.roles[0]
+	for id := 1; id <= 100; id++ {
+		if _, err := idetc.set(r.slotKey(id), `{"ipv4":"10.0.0.1"}`); err != nil {
+			b.Fatalf("Could not fill the slot %d: %s", id, err)
+		}
+	}
+	if cache, ok := idetc.store.(*recordCache); ok {
+		if _, err := cache.load(r); err != nil {
+			b.Fatalf("Could not load the records: %s", err)
+		}
+	}
+	latencies := make([]time.Duration, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("worker"+strconv.Itoa(i%100+1)+".tf.local.", dns.TypeA)
+		begin := time.Now()
+		idetc.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+		latencies[i] = time.Since(begin)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.Logf("%d queries: %.0f qps, p99 %s", b.N, float64(b.N)/elapsed.Seconds(), latencies[b.N*99/100])
+	deleteAll()
+}
+
+//BenchmarkServeDNSEtcd answers every query by reading the etcd, which is what idetcd used to do.
+func BenchmarkServeDNSEtcd(b *testing.B) {
+	idetc := newCacheIdetcd(b)
+	defer idetc.Client.Close()
+	idetc.store = etcdStore{idetc}
+	benchmarkServeDNS(b, idetc)
+}
+
+//BenchmarkServeDNSCache answers every query from the records in memory.
+func BenchmarkServeDNSCache(b *testing.B) {
+	idetc := newCacheIdetcd(b)
+	defer idetc.Client.Close()
+	idetc.store = newRecordCache(idetc)
+	benchmarkServeDNS(b, idetc)
+}
@@ -0,0 +1,124 @@
+package idetcd
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+)
+
+//Config is the format of the cluster-wide configuration of a role that idetcd reads from the etcd, the values which are set
+//override the ones in the Corefile.
+type Config struct {
+	//Limit is the maximum limit of the node number of the role, it is applied at runtime when it changes.
+	Limit int `json:"limit,omitempty"`
+	//Pattern is the domain name pattern of the nodes, it is only applied when the node starts up.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+//loadConfig reads the cluster-wide configuration of the role from the etcd when the node starts up and applies it, it returns
+//the revision of the read.
+func (idetcd *Idetcd) loadConfig(r *role) (int64, error) {
+	config, rev, err := idetcd.readConfig(r)
+	if err != nil {
+		return 0, err
+	}
+	if config.Pattern != "" && config.Pattern != r.currentPattern().text {
+		idetcd.applyPattern(r, config.Pattern)
+	}
+	idetcd.applyLimit(r, config.Limit)
+	return rev, nil
+}
+
+//applyPattern replaces the domain name pattern of the role, unless it is invalid or another role has the same pattern, as they
+//would share their slots in the etcd.
+func (idetcd *Idetcd) applyPattern(r *role, text string) {
+	pattern, err := parsePattern(text)
+	if err != nil {
+		log.Errorf("Invalid pattern in %s: %s", r.configKey, err)
+		return
+	}
+	for _, other := range idetcd.roles {
+		if other != r && other.currentPattern().prefix == pattern.prefix {
+			log.Errorf("Pattern in %s is the same as the one of role %s, ignoring it", r.configKey, other.name)
+			return
+		}
+	}
+	r.mu.Lock()
+	r.pattern = pattern
+	r.mu.Unlock()
+}
+
+//readConfig reads the cluster-wide configuration of the role from the etcd, an empty configuration is returned if there is none.
+func (idetcd *Idetcd) readConfig(r *role) (Config, int64, error) {
+	config := Config{}
+	resp, err := idetcd.get(r.configKey)
+	if err != nil {
+		return config, 0, err
+	}
+	if resp.Count != 0 {
+		if err := json.Unmarshal(resp.Kvs[0].Value, &config); err != nil {
+			log.Errorf("Invalid cluster configuration in %s: %s", r.configKey, err)
+		}
+	}
+	return config, resp.Header.Revision, nil
+}
+
+//watchConfig watches the cluster-wide configuration of the role until ctx is done, and applies the limit every time it changes.
+//The configuration is read again if the watch is canceled, e.g. the revision has been compacted.
+func (idetcd *Idetcd) watchConfig(ctx context.Context, r *role, rev int64) {
+	for ctx.Err() == nil {
+		for resp := range idetcd.Client.Watch(ctx, r.configKey, etcdcv3.WithRev(rev+1)) {
+			if resp.Err() != nil {
+				log.Warningf("Watch of the cluster configuration in %s is canceled: %s", r.configKey, resp.Err())
+				break
+			}
+			for _, ev := range resp.Events {
+				config := Config{}
+				if ev.Type == etcdcv3.EventTypePut {
+					if err := json.Unmarshal(ev.Kv.Value, &config); err != nil {
+						log.Errorf("Invalid cluster configuration in %s: %s", r.configKey, err)
+						continue
+					}
+				}
+				idetcd.applyLimit(r, config.Limit)
+				rev = ev.Kv.ModRevision
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		config, current, err := idetcd.readConfig(r)
+		if err != nil {
+			log.Errorf("Could not read the cluster configuration in %s: %s", r.configKey, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(idetcd.timeout):
+			}
+			continue
+		}
+		idetcd.applyLimit(r, config.Limit)
+		rev = current
+	}
+}
+
+//applyLimit sets the limit of the role, the limit in the Corefile is used if limit is not positive.
+//Nodes which have taken slots above the new limit are not evicted, they keep their slots until they leave the cluster, and the
+//slots are not taken again.
+func (idetcd *Idetcd) applyLimit(r *role, limit int) {
+	if limit <= 0 {
+		limit = r.corefileLimit
+	}
+	r.mu.Lock()
+	previous := r.limit
+	r.limit = limit
+	r.mu.Unlock()
+	if limit == previous {
+		return
+	}
+	log.Infof("Limit of role %s is changed from %d to %d", r.name, previous, limit)
+	if current, id := idetcd.slot(); current == r && id > limit {
+		log.Warningf("Slot %d is above the new limit %d, draining it until the node leaves the cluster", id, limit)
+	}
+}
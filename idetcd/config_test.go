@@ -0,0 +1,132 @@
+package idetcd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestApplyLimit(t *testing.T) {
+	idetc := &Idetcd{}
+	r := &role{name: defaultRole, limit: 5, corefileLimit: 5}
+	tests := []struct {
+		limit         int
+		expectedLimit int
+	}{
+		{16, 16},
+		{8, 8},
+		{0, 5},
+		{-1, 5},
+	}
+	for i, test := range tests {
+		idetc.applyLimit(r, test.limit)
+		if r.currentLimit() != test.expectedLimit {
+			t.Errorf("Test %d: Expected limit %d, got: %d", i, test.expectedLimit, r.currentLimit())
+		}
+	}
+}
+
+func TestApplyPattern(t *testing.T) {
+	ps, _ := newRole("ps", "ps{{.ID}}.tf.local.", 2)
+	worker, _ := newRole("worker", "worker{{.ID}}.tf.local.", 8)
+	idetc := &Idetcd{roles: []*role{ps, worker}}
+	tests := []struct {
+		pattern        string
+		expectedPrefix string
+	}{
+		{"node{{.ID}}.tf.local.", "/idetcd/node*.tf.local./"},
+		//The pattern of another role and invalid patterns are ignored.
+		{"PS{{.ID}}.tf.local.", "/idetcd/node*.tf.local./"},
+		{"worker.tf.local.", "/idetcd/node*.tf.local./"},
+	}
+	for i, test := range tests {
+		idetc.applyPattern(worker, test.pattern)
+		if prefix := worker.currentPattern().prefix; prefix != test.expectedPrefix {
+			t.Errorf("Test %d: Expected prefix %s, got: %s", i, test.expectedPrefix, prefix)
+		}
+	}
+}
+
+func TestConfigKey(t *testing.T) {
+	tests := []struct {
+		input             string
+		expectedConfigKey string
+	}{
+		{`idetcd {
+			pattern worker{{.ID}}.tf.local.
+		}`, "/idetcd/worker*.tf.local./config"},
+		{`idetcd {
+			pattern worker{{.ID}}.tf.local.
+			config /tf/cluster
+		}`, "/tf/cluster"},
+	}
+	for i, test := range tests {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", test.input))
+		if err != nil {
+			t.Fatalf("Test %d: Could not parse the corefile: %s", i, err)
+		}
+		if idetc.roles[0].configKey != test.expectedConfigKey {
+			t.Errorf("Test %d: Expected config key %s, got: %s", i, test.expectedConfigKey, idetc.roles[0].configKey)
+		}
+	}
+}
+
+func TestRaiseLimitAtRuntime(t *testing.T) {
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit 1
+			when_full wait
+		}`
+	var nodes []*Idetcd
+	for i := 0; i < 2; i++ {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("Could not parse the corefile: %s", err)
+		}
+		if err := idetc.connect(); err != nil {
+			t.Fatalf("Could not connect to etcd: %s", err)
+		}
+		defer idetc.Client.Close()
+		lease, err := idetc.grant()
+		if err != nil {
+			t.Fatalf("Could not grant the lease: %s", err)
+		}
+		idetc.lease = lease.ID
+		nodes = append(nodes, idetc)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, idetc := range nodes {
+		rev, err := idetc.loadConfig(idetc.roles[0])
+		if err != nil {
+			t.Fatalf("Could not load the cluster configuration: %s", err)
+		}
+		go idetc.watchConfig(ctx, idetc.roles[0], rev)
+	}
+	if name, err := nodes[0].claimSlot("0", nodes[0].lease); err != nil || name == "" {
+		t.Fatalf("Expected node 0 to take the only slot, got: %q, %v", name, err)
+	}
+	promoted := make(chan string, 1)
+	go func() { promoted <- nodes[1].waitSlot(ctx, "1") }()
+
+	config, _ := json.Marshal(Config{Limit: 2})
+	if _, err := nodes[0].set(nodes[0].roles[0].configKey, string(config)); err != nil {
+		t.Fatalf("Could not set the cluster configuration: %s", err)
+	}
+	select {
+	case name := <-promoted:
+		if name != "worker2.tf.local." {
+			t.Errorf("Expected node 1 to take worker2.tf.local., got: %s", name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected node 1 to take a new slot after the limit is raised, got none")
+	}
+	if nodes[0].roles[0].currentLimit() != 2 {
+		t.Errorf("Expected limit of node 0 to be 2, got: %d", nodes[0].roles[0].currentLimit())
+	}
+	deleteAll()
+}
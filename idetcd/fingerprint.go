@@ -0,0 +1,80 @@
+package idetcd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//machineIDFiles are the files where the machine id can be found, in the order of preference.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+//fingerprint returns a stable fingerprint of current node which survives restarts, it can be read from:
+//machine-id: the machine id of the host.
+//mac: the hardware address of the first interface after loopback interface.
+//file PATH: a local state file, which is created with a random fingerprint if it does not exist yet.
+func fingerprint(source string, args ...string) (string, error) {
+	switch source {
+	case "machine-id":
+		if len(args) != 0 {
+			return "", fmt.Errorf("machine-id fingerprint takes no argument")
+		}
+		for _, file := range machineIDFiles {
+			id, err := ioutil.ReadFile(file)
+			if err == nil && len(strings.TrimSpace(string(id))) != 0 {
+				return strings.TrimSpace(string(id)), nil
+			}
+		}
+		return "", fmt.Errorf("could not find the machine id in %v", machineIDFiles)
+	case "mac":
+		if len(args) != 0 {
+			return "", fmt.Errorf("mac fingerprint takes no argument")
+		}
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return "", err
+		}
+		for _, inter := range interfaces {
+			if inter.Flags&net.FlagLoopback == 0 && len(inter.HardwareAddr) != 0 {
+				return inter.HardwareAddr.String(), nil
+			}
+		}
+		return "", fmt.Errorf("could not find any interface with a hardware address")
+	case "file":
+		if len(args) != 1 {
+			return "", fmt.Errorf("file fingerprint takes exactly one path")
+		}
+		return fileFingerprint(args[0])
+	}
+	return "", fmt.Errorf("unknown fingerprint source: %s", source)
+}
+
+//fileFingerprint reads the fingerprint from the state file, if the file does not exist, a random fingerprint is generated and saved in it.
+func fileFingerprint(path string) (string, error) {
+	id, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(strings.TrimSpace(string(id))) == 0 {
+			return "", fmt.Errorf("fingerprint file %s is empty", path)
+		}
+		return strings.TrimSpace(string(id)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(buf)+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,51 @@
+package idetcd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idetcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "fingerprint")
+
+	first, err := fingerprint("file", path)
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if first == "" {
+		t.Fatalf("Expected a generated fingerprint, got none")
+	}
+	//The fingerprint should be the same after restart.
+	second, err := fingerprint("file", path)
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if first != second {
+		t.Errorf("Expected fingerprint %s to be stable, got: %s", first, second)
+	}
+}
+
+func TestFingerprintArgs(t *testing.T) {
+	tests := []struct {
+		source string
+		args   []string
+	}{
+		{"file", nil},
+		{"file", []string{"a", "b"}},
+		{"mac", []string{"a"}},
+		{"machine-id", []string{"a"}},
+		{"hostname", nil},
+	}
+	for i, test := range tests {
+		if _, err := fingerprint(test.source, test.args...); err == nil {
+			t.Errorf("Test %d: Expected error but found none for %s %v", i, test.source, test.args)
+		}
+	}
+}
@@ -3,87 +3,327 @@ package idetcd
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"net"
-	"text/template"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	etcdcv3 "github.com/coreos/etcd/clientv3"
 	"github.com/miekg/dns"
 )
 
-const (
-	timeout = 5
-)
+var log = clog.NewWithPlugin("idetcd")
 
 //Idetcd is a plugin which can configure the cluster without collison.
 type Idetcd struct {
-	Next      plugin.Handler
-	Ctx       context.Context
-	Client    *etcdcv3.Client
-	endpoints []string
-	pattern   *template.Template
-	ID        int
-	limit     int
+	Next   plugin.Handler
+	Ctx    context.Context
+	Client *etcdcv3.Client
+	//clientConfig is the configuration of the etcd client, the client is only created once the node starts connecting to etcd.
+	clientConfig etcdcv3.Config
+	endpoints    []string
+	ID           int
+	//roles are the kinds of nodes in the cluster in priority order, every role has its own pattern and limit.
+	roles []*role
+	//assign is the name of the role which current node takes, it is empty if the node takes the roles in priority order.
+	assign string
+	//role is the role of the slot which current node has taken.
+	role *role
+	//mu protects ID, role, value, state and lease, which are read by other goroutines while the node takes a slot.
+	mu sync.RWMutex
+	//value is the record of current node in json format which is put in its slot.
+	value string
+	//state is the state of current node in its lifecycle, e.g. connecting to etcd or holding a slot.
+	state string
+	//fingerprint identifies current node across restarts, it is empty if sticky identity is not configured.
+	fingerprint string
+	//whenFull is what the node does if all the slots are taken at startup, either fail or wait for a free slot.
+	whenFull string
+	//maxWait is the maximum time the node waits for a free slot, 0 means to wait forever.
+	maxWait time.Duration
+	//lease is the only lease which current node attaches its record to, it is kept alive during the whole life of the node.
+	lease etcdcv3.LeaseID
+	//ttl is the ttl of the lease, the record of current node is deleted once the node has not renewed the lease for that long.
+	ttl time.Duration
+	//renew is the interval between the renewals of the lease, a random delay up to jitter is added to every interval.
+	renew  time.Duration
+	jitter time.Duration
+	//answerTTL is the ttl of the answers in seconds, it is not above the ttl of the lease.
+	answerTTL uint32
+	//timeout is the timeout of every request to the etcd.
+	timeout time.Duration
+	//store is where ServeDNS reads the records from.
+	store store
+	//maxStale is how long the records in memory are used to answer queries while etcd is unreachable, 0 means that queries
+	//fail with SERVFAIL as soon as etcd is unreachable.
+	maxStale time.Duration
+	//zones are the zones idetcd answers for, they are the zones of the roles if none is set in the Corefile.
+	zones []string
+	//fall passes the queries for the names in the zones which are not taken by any node to the next plugin.
+	fall fall.F
+	//port is the port which current node advertises in its record, it defaults to the port of the DNS server.
+	port string
+	//selector picks the local addresses which current node publishes in its record.
+	selector addrSelector
+	//startupTimeout is how long the startup waits for current node to claim a slot, the node keeps trying in the background after.
+	startupTimeout time.Duration
+	//refresh is how often the addresses of current node are computed again, 0 means that they are only computed at startup.
+	refresh time.Duration
+	//shutdown stops the lifecycle of the slot and releases it, it is run on graceful shutdown.
+	shutdown func() error
 }
 
 //Record is the format of record that idetcd saves in the etcd.
 type Record struct {
+	//Ipv4 and Ipv6 are the first addresses of the node in every family, they are kept for the nodes which only read them.
 	Ipv4 string `json:"ipv4,omitempty"`
 	Ipv6 string `json:"ipv6,omitempty"`
-	Port string `json:"port,omitempty"`
+	//Ipv4s and Ipv6s are all the addresses of the node in every family in the order of preference.
+	Ipv4s []string `json:"ipv4s,omitempty"`
+	Ipv6s []string `json:"ipv6s,omitempty"`
+	Port  string   `json:"port,omitempty"`
+	//Fingerprint is the stable fingerprint of the node which holds the record.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+//addresses returns all the addresses in the record in their canonical text form, the ipv4 addresses come first.
+func (record *Record) addresses() []string {
+	var addrs []string
+	for _, ip := range append(record.ipv4s(), record.ipv6s()...) {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs
+}
+
+//ipv4s returns the ipv4 addresses in the record in the order of preference, records written by older nodes only have one.
+func (record *Record) ipv4s() []net.IP {
+	var ips []net.IP
+	for _, addr := range fallback(record.Ipv4s, record.Ipv4) {
+		if ip := net.ParseIP(addr).To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+//ipv6s returns the ipv6 addresses in the record in the order of preference, records written by older nodes only have one.
+func (record *Record) ipv6s() []net.IP {
+	var ips []net.IP
+	for _, addr := range fallback(record.Ipv6s, record.Ipv6) {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func fallback(addrs []string, addr string) []string {
+	if len(addrs) != 0 || addr == "" {
+		return addrs
+	}
+	return []string{addr}
 }
 
 //ServeDNS implements the plugin.Handler interface
+//It answers authoritatively for the names in the zones of the roles: names of the slots which are not taken by any node get
+//NXDOMAIN, and names without a record of the queried type get NODATA, both with the SOA record of the zone. Service names of
+//the slots, e.g. _grpc._tcp.worker3.tf.local., are answered with SRV records, and _members in the zone, e.g. _members.tf.local.,
+//is answered with the records of all the claimed slots. The zone itself has an SOA record, and an NS record for every member.
+//PTR queries for the addresses of the members are answered with the names of all the slots which have the address.
 func (idetcd *Idetcd) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
+	qname := state.Name()
+	zone := idetcd.zone(qname)
+	var addr string
+	if zone == "" && state.QType() == dns.TypePTR {
+		if ip := net.ParseIP(dnsutil.ExtractAddressFromReverse(qname)); ip != nil {
+			addr = ip.String()
+		}
+	}
+	if zone == "" && addr == "" {
+		return plugin.NextOrFailure(idetcd.Name(), idetcd.Next, ctx, w, r)
+	}
+	//The slots are unknown until the records have been read, so no name can be told to exist or not. The records in memory are
+	//used while etcd is unreachable only if serving stale answers is enabled, and only until they have been stale for longer
+	//than the maximum staleness.
+	var unavailable error
+	stale := idetcd.store.staleness()
+	if !idetcd.store.loaded() {
+		unavailable = fmt.Errorf("the records have not been read from etcd yet")
+	} else if stale > idetcd.maxStale {
+		unavailable = fmt.Errorf("the records have been stale for %s", stale)
+	}
+	if unavailable != nil {
+		//idetcd is not authoritative for the reverse zones, so the reverse lookups are left to the next plugin while the members
+		//are unknown.
+		if addr != "" {
+			return plugin.NextOrFailure(idetcd.Name(), idetcd.Next, ctx, w, r)
+		}
+		return dns.RcodeServerFailure, unavailable
+	}
 	a := new(dns.Msg)
 	a.SetReply(r)
 	a.Authoritative = true
-	qname := state.Name()
-	resp, _ := idetcd.get(qname)
-	record := new(Record)
-	json.Unmarshal(resp.Kvs[0].Value, record)
-	var rr dns.RR
-	switch state.QType() {
-	case dns.TypeA:
-		rr = new(dns.A)
-		rr.(*dns.A).Hdr = dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: state.QClass()}
-		rr.(*dns.A).A = net.ParseIP(record.Ipv4).To4()
-	case dns.TypeAAAA:
-		rr = new(dns.AAAA)
-		rr.(*dns.AAAA).Hdr = dns.RR_Header{Name: qname, Rrtype: dns.TypeAAAA, Class: state.QClass()}
-		rr.(*dns.AAAA).AAAA = net.ParseIP(record.Ipv6).To16()
-
-	}
-	a.Answer = []dns.RR{rr}
+	var err error
+	switch qname {
+	case zone:
+		err = idetcd.apex(state, zone, a)
+	case membersLabel + "." + zone:
+		err = idetcd.members(state, zone, a)
+	default:
+		if addr != "" {
+			err = idetcd.ptr(state, addr, a)
+		} else {
+			err = idetcd.lookup(state, a)
+		}
+	}
+	if err == nil && len(a.Answer) == 0 {
+		//idetcd is not authoritative for the reverse zones, so the addresses out of the cluster are left to the next plugin.
+		if addr != "" {
+			return plugin.NextOrFailure(idetcd.Name(), idetcd.Next, ctx, w, r)
+		}
+		var soa *dns.SOA
+		if soa, err = idetcd.soa(zone); err == nil {
+			a.Ns = []dns.RR{soa}
+		}
+	}
+	if err != nil {
+		log.Errorf("Could not read the records of %s: %s", qname, err)
+		return dns.RcodeServerFailure, err
+	}
+	if a.Rcode == dns.RcodeNameError && idetcd.fall.Through(qname) {
+		return plugin.NextOrFailure(idetcd.Name(), idetcd.Next, ctx, w, r)
+	}
+	if stale > 0 {
+		staleAnswers.Inc()
+		capTTL(a, staleTTL)
+	}
 	w.WriteMsg(a)
-	return plugin.NextOrFailure(idetcd.Name(), idetcd.Next, ctx, w, r)
+	return dns.RcodeSuccess, nil
 }
 
 //set is a wrapper for client.Set
 func (idetcd *Idetcd) set(key string, value string, opts ...etcdcv3.OpOption) (*etcdcv3.PutResponse, error) {
-	ctx, cancel := context.WithTimeout(idetcd.Ctx, timeout*time.Second)
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
 	defer cancel()
 	r, err := idetcd.Client.Put(ctx, key, value, opts...)
 	if err != nil {
-		return r, err
+		return r, authError(err)
+	}
+	return r, nil
+}
+
+//claim is a wrapper for a transaction which puts the key attached to the lease only if it does not exist in the etcd yet, the
+//other operations are done in the same transaction. It returns false if the key has already been created by another node.
+func (idetcd *Idetcd) claim(key string, value string, lease etcdcv3.LeaseID, also ...etcdcv3.Op) (bool, error) {
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
+	defer cancel()
+	r, err := idetcd.Client.Txn(ctx).
+		If(etcdcv3.Compare(etcdcv3.CreateRevision(key), "=", 0)).
+		Then(append([]etcdcv3.Op{etcdcv3.OpPut(key, value, etcdcv3.WithLease(lease))}, also...)...).
+		Commit()
+	if err != nil {
+		return false, authError(err)
+	}
+	return r.Succeeded, nil
+}
+
+//del is a wrapper for client.Delete
+func (idetcd *Idetcd) del(key string, opts ...etcdcv3.OpOption) (*etcdcv3.DeleteResponse, error) {
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
+	defer cancel()
+	r, err := idetcd.Client.Delete(ctx, key, opts...)
+	if err != nil {
+		return nil, authError(err)
+	}
+	return r, nil
+}
+
+//grant is a wrapper for client.Grant, the lease is granted with the ttl of current node.
+func (idetcd *Idetcd) grant() (*etcdcv3.LeaseGrantResponse, error) {
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
+	defer cancel()
+	r, err := idetcd.Client.Grant(ctx, int64(idetcd.ttl/time.Second))
+	if err != nil {
+		return nil, authError(err)
 	}
 	return r, nil
 }
 
 // get is a wrapper for client.Get
-func (idetcd *Idetcd) get(key string) (*etcdcv3.GetResponse, error) {
-	ctx, cancel := context.WithTimeout(idetcd.Ctx, timeout*time.Second)
+func (idetcd *Idetcd) get(key string, opts ...etcdcv3.OpOption) (*etcdcv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
 	defer cancel()
-	r, err := idetcd.Client.Get(ctx, key)
+	r, err := idetcd.Client.Get(ctx, key, opts...)
 	if err != nil {
-		return nil, err
+		return nil, authError(err)
 	}
 	return r, nil
 }
 
+//slot returns the role and the id of the slot which current node has taken, the id is 0 if it has not taken any slot.
+func (idetcd *Idetcd) slot() (*role, int) {
+	idetcd.mu.RLock()
+	defer idetcd.mu.RUnlock()
+	return idetcd.role, idetcd.ID
+}
+
+//currentLease returns the lease which current node attaches its record to, it is 0 if the node has not got a lease yet.
+func (idetcd *Idetcd) currentLease() etcdcv3.LeaseID {
+	idetcd.mu.RLock()
+	defer idetcd.mu.RUnlock()
+	return idetcd.lease
+}
+
+//slotOf returns the role and the id of the slot which the domain name belongs to.
+func (idetcd *Idetcd) slotOf(name string) (*role, int, bool) {
+	for _, r := range idetcd.roles {
+		if id, ok := r.slotID(name); ok {
+			return r, id, true
+		}
+	}
+	return nil, 0, false
+}
+
+//nameOf returns the domain name of the slot whose record is saved in the key.
+func (idetcd *Idetcd) nameOf(key string) (string, bool) {
+	for _, r := range idetcd.roles {
+		if !strings.HasPrefix(key, r.slotPrefix()) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(key, r.slotPrefix()))
+		if err != nil {
+			return "", false
+		}
+		name, err := r.domainName(id)
+		return name, err == nil
+	}
+	return "", false
+}
+
+//limits returns the limits of the roles which current node can take, for logging.
+func (idetcd *Idetcd) limits() string {
+	var limits []string
+	for _, r := range idetcd.candidates() {
+		limits = append(limits, strconv.Itoa(r.currentLimit())+" "+r.name)
+	}
+	return strings.Join(limits, ", ")
+}
+
+//candidates returns the roles which current node can take in priority order.
+func (idetcd *Idetcd) candidates() []*role {
+	if idetcd.assign != "" {
+		return []*role{findRole(idetcd.roles, idetcd.assign)}
+	}
+	return idetcd.roles
+}
+
 //Name implements the Handler interface.
 func (idetcd *Idetcd) Name() string { return "idetcd" }
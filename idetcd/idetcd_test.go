@@ -3,8 +3,8 @@ package idetcd
 
 import (
 	"context"
-	"log"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,7 +18,7 @@ import (
 	"github.com/miekg/dns"
 )
 
-var localIP = iP()
+var localIP, _ = (&addrSelector{}).record()
 var directives = []string{
 	"metadata",
 	"tls",
@@ -84,7 +84,7 @@ func TestBasicLookupNodesRR(t *testing.T) {
 	for _, node := range nodes {
 		node.ShutdownCallbacks()
 	}
-	delete()
+	deleteAll()
 }
 
 func TestNodeUpAfterTTL(t *testing.T) {
@@ -131,7 +131,7 @@ func TestNodeUpAfterTTL(t *testing.T) {
 	for _, node := range nodes {
 		node.ShutdownCallbacks()
 	}
-	delete()
+	deleteAll()
 }
 
 func TestNodeTakeFreeSlot(t *testing.T) {
@@ -194,11 +194,165 @@ func TestNodeTakeFreeSlot(t *testing.T) {
 	for _, node := range nodes {
 		node.ShutdownCallbacks()
 	}
-	delete()
+	deleteAll()
+}
+
+func TestConcurrentClaimUnique(t *testing.T) {
+	numNode := 64
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit ` + strconv.Itoa(numNode) + `
+		}`
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		names = make(map[string]int)
+	)
+	//Start one more node than the limit, so exactly one of them should fail to find a free slot.
+	for i := 0; i <= numNode; i++ {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("Could not parse the corefile: %s", err)
+		}
+		if err := idetc.connect(); err != nil {
+			t.Fatalf("Could not connect to etcd: %s", err)
+		}
+		defer idetc.Client.Close()
+		wg.Add(1)
+		go func(i int, idetc *Idetcd) {
+			defer wg.Done()
+			lease, err := idetc.grant()
+			if err != nil {
+				t.Errorf("Could not grant the lease for node %d: %s", i, err)
+				return
+			}
+			name, err := idetc.claimSlot(strconv.Itoa(i), lease.ID)
+			if err != nil {
+				t.Errorf("Could not claim the slot for node %d: %s", i, err)
+				return
+			}
+			mu.Lock()
+			names[name]++
+			mu.Unlock()
+		}(i, idetc)
+	}
+	wg.Wait()
+
+	for i := 1; i <= numNode; i++ {
+		name := "worker" + strconv.Itoa(i) + ".tf.local."
+		if names[name] != 1 {
+			t.Errorf("Expected %s to be taken by exactly one node, got: %d", name, names[name])
+		}
+	}
+	if names[""] != 1 {
+		t.Errorf("Expected exactly one node without a free slot, got: %d", names[""])
+	}
+	deleteAll()
+}
+
+func TestKeepAliveSingleLease(t *testing.T) {
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit 1
+		}`
+	idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("Could not parse the corefile: %s", err)
+	}
+	if err := idetc.connect(); err != nil {
+		t.Fatalf("Could not connect to etcd: %s", err)
+	}
+	defer idetc.Client.Close()
+	lease, err := idetc.grant()
+	if err != nil {
+		t.Fatalf("Could not grant the lease: %s", err)
+	}
+	idetc.lease = lease.ID
+	idetc.value = "value"
+	name, err := idetc.claimSlot(idetc.value, idetc.lease)
+	if err != nil || name == "" {
+		t.Fatalf("Could not claim the slot: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go idetc.run(ctx, name)
+
+	//Wait for longer than the ttl, the record should still be attached to the same lease.
+	time.Sleep(defaultTTL + 5*time.Second)
+	resp, err := idetc.get(idetc.role.slotKey(idetc.ID))
+	if err != nil {
+		t.Fatalf("Expected to get the record, but didn't: %s", err)
+	}
+	if resp.Count != 1 {
+		t.Fatalf("Expected the record of %s to be kept alive, got none", name)
+	}
+	if clientv3.LeaseID(resp.Kvs[0].Lease) != lease.ID {
+		t.Errorf("Expected the record to be attached to lease %x, got: %x", lease.ID, resp.Kvs[0].Lease)
+	}
+	deleteAll()
+}
+
+func TestStickyIdentity(t *testing.T) {
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit 5
+		}`
+	var nodes []*Idetcd
+	for _, finger := range []string{"node-a", "node-b"} {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("Could not parse the corefile: %s", err)
+		}
+		if err := idetc.connect(); err != nil {
+			t.Fatalf("Could not connect to etcd: %s", err)
+		}
+		defer idetc.Client.Close()
+		idetc.fingerprint = finger
+		nodes = append(nodes, idetc)
+	}
+	claim := func(idetc *Idetcd) (string, clientv3.LeaseID) {
+		lease, err := idetc.grant()
+		if err != nil {
+			t.Fatalf("Could not grant the lease: %s", err)
+		}
+		name, err := idetc.claimSlot(idetc.fingerprint, lease.ID)
+		if err != nil {
+			t.Fatalf("Could not claim the slot: %s", err)
+		}
+		return name, lease.ID
+	}
+	nameA, leaseA := claim(nodes[0])
+	nameB, leaseB := claim(nodes[1])
+	//Restart both nodes, and let node b come back first.
+	nodes[0].Client.Revoke(context.TODO(), leaseA)
+	nodes[1].Client.Revoke(context.TODO(), leaseB)
+	if name, _ := claim(nodes[1]); name != nameB {
+		t.Errorf("Expected node b to take %s back, got: %s", nameB, name)
+	}
+	if name, _ := claim(nodes[0]); name != nameA {
+		t.Errorf("Expected node a to take %s back, got: %s", nameA, name)
+	}
+	deleteAll()
+}
+
+//lookup resolves the name of node i, it retries for a while until the answer has a RR, as the records of other nodes only reach
+//the cache of the serving node through its watch.
+func lookup(i int, state request.Request, p proxy.Proxy, qtype uint16) (*dns.Msg, error) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := p.Lookup(state, "worker"+strconv.Itoa(i+1)+".tf.local.", qtype)
+		if err != nil || len(resp.Answer) != 0 || time.Now().After(deadline) {
+			return resp, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 func checkAnswer(i int, state request.Request, p proxy.Proxy, t *testing.T) {
-	resp, err := p.Lookup(state, "worker"+strconv.Itoa(i+1)+".tf.local.", dns.TypeA)
+	resp, err := lookup(i, state, p, dns.TypeA)
 	if err != nil {
 		t.Fatalf("Expected to receive reply, but didn't: %v", err)
 	}
@@ -213,7 +367,7 @@ func checkAnswer(i int, state request.Request, p proxy.Proxy, t *testing.T) {
 	}
 
 	//test for ipv6
-	resp, err = p.Lookup(state, "worker"+strconv.Itoa(i+1)+".tf.local.", dns.TypeAAAA)
+	resp, err = lookup(i, state, p, dns.TypeAAAA)
 	if err != nil {
 		t.Fatalf("Expected to receive reply, but didn't: %v", err)
 	}
@@ -246,7 +400,8 @@ func generateCorefiles(numNode int) []string {
 	return corefiles
 }
 
-func delete() {
+//deleteAll deletes all the keys idetcd has saved in the etcd.
+func deleteAll() {
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints: []string{defaultEndpoint},
 	})
@@ -255,5 +410,5 @@ func delete() {
 	}
 	defer cli.Close()
 	ctx := context.Background()
-	cli.Delete(ctx, "worker", clientv3.WithPrefix())
+	cli.Delete(ctx, "/idetcd/", clientv3.WithPrefix())
 }
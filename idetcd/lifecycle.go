@@ -0,0 +1,359 @@
+package idetcd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+const (
+	//The states of current node, which are logged and exported in the state metric.
+	stateConnecting = "connecting"
+	stateWaiting    = "waiting"
+	stateClaimed    = "claimed"
+	stateRecovering = "recovering"
+	stateReleased   = "released"
+
+	//minBackoff and maxBackoff bound the delay between the retries of the requests to etcd which have failed.
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var states = []string{stateConnecting, stateWaiting, stateClaimed, stateRecovering, stateReleased}
+
+//errFull is returned at startup if all the slots are taken and current node is not configured to wait for a free slot.
+var errFull = errors.New("all the slots are taken")
+
+//backoff is the exponential delay between the retries of a failed request.
+type backoff struct {
+	delay time.Duration
+}
+
+//next returns the delay before the next retry, it doubles every time up to maxBackoff, with a random jitter so the nodes do not
+//retry at the same time.
+func (b *backoff) next() time.Duration {
+	b.delay *= 2
+	if b.delay == 0 {
+		b.delay = minBackoff
+	}
+	if b.delay > maxBackoff {
+		b.delay = maxBackoff
+	}
+	return b.delay/2 + time.Duration(rand.Int63n(int64(b.delay/2)+1))
+}
+
+//retry waits for the next delay of the backoff, it returns false if ctx is done.
+func (b *backoff) retry(ctx context.Context) bool {
+	retries.Inc()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(b.next()):
+		return true
+	}
+}
+
+//setState records the state of current node in the logs and the state metric.
+func (idetcd *Idetcd) setState(state string) {
+	idetcd.mu.Lock()
+	changed := idetcd.state != state
+	idetcd.state = state
+	idetcd.mu.Unlock()
+	if !changed {
+		return
+	}
+	log.Infof("Current node is %s", state)
+	for _, s := range states {
+		if s == state {
+			stateGauge.WithLabelValues(s).Set(1)
+		} else {
+			stateGauge.WithLabelValues(s).Set(0)
+		}
+	}
+}
+
+//start connects current node to etcd and claims a slot in the background until ctx is done, the requests which fail are retried
+//with exponential backoff. Once the node has claimed a slot, or it waits for a free slot, the result is sent on started unless
+//detached is closed, i.e. the startup does not wait for it any more. At startup errFull is sent if all the slots are taken and
+//the node is not configured to wait, later the node just keeps trying to claim a slot.
+//Then the slot is kept during the whole life of the node.
+func (idetcd *Idetcd) start(ctx context.Context, cache *recordCache, started chan<- error, detached <-chan struct{}) {
+	idetcd.setState(stateConnecting)
+	report := func(err error) bool {
+		select {
+		case started <- err:
+			return true
+		case <-detached:
+			return false
+		}
+	}
+
+	b := &backoff{}
+	for {
+		err := idetcd.connect()
+		if err == nil {
+			break
+		}
+		log.Errorf("Could not connect to etcd, retrying: %s", err)
+		if !b.retry(ctx) {
+			return
+		}
+	}
+
+	//The cluster-wide configuration in the etcd overrides the Corefile, and it is watched so the limit can be changed at runtime.
+	//ServeDNS answers from the records in memory, which are kept current by watching the slots in the etcd.
+	b = &backoff{}
+	revs := make([]int64, len(idetcd.roles))
+	cacheRevs := make([]int64, len(idetcd.roles))
+	for i := 0; i < len(idetcd.roles); {
+		var err error
+		r := idetcd.roles[i]
+		if revs[i], err = idetcd.loadConfig(r); err == nil {
+			cacheRevs[i], err = cache.load(r)
+		}
+		if err != nil {
+			log.Errorf("Could not read role %s from etcd, retrying: %s", r.name, err)
+			if !b.retry(ctx) {
+				return
+			}
+			continue
+		}
+		i++
+	}
+	for i, r := range idetcd.roles {
+		go idetcd.watchConfig(ctx, r, revs[i])
+		go cache.watch(ctx, r, cacheRevs[i])
+	}
+	go cache.probe(ctx)
+	if idetcd.refresh > 0 {
+		go idetcd.watchAddresses(ctx)
+	}
+
+	//Try to find a free slot for current node, the record is attached to a lease with ttl in etcd.
+	b = &backoff{}
+	var name string
+	for {
+		err := idetcd.renewLease()
+		if err == nil {
+			name, err = idetcd.claimSlot(idetcd.currentValue(), idetcd.currentLease())
+		}
+		if err == nil && name == "" && idetcd.whenFull != whenFullWait {
+			err = errFull
+			if report(err) {
+				return
+			}
+		}
+		if err == nil {
+			break
+		}
+		log.Errorf("Could not claim a slot, retrying: %s", err)
+		if !b.retry(ctx) {
+			return
+		}
+	}
+	report(nil)
+	idetcd.run(ctx, name)
+}
+
+//run keeps the slot of current node during the whole life of the node until ctx is done, name is the domain name of the slot
+//the node has taken at startup, or an empty string if it has to wait for a free slot. The slots are taken with the current
+//record of the node, which may change while the node is alive.
+//Once the node loses the ownership of its slot, e.g. the lease has expired while etcd was unreachable or the record has been
+//deleted, it tries to take the same slot back, and takes another free slot if the same one has been taken by other node.
+func (idetcd *Idetcd) run(ctx context.Context, name string) {
+	for {
+		if name == "" {
+			//The node still serves DNS as a read-only member while it is waiting.
+			log.Infof("All the %s slots are taken, waiting for a free slot", idetcd.limits())
+			idetcd.setState(stateWaiting)
+			if name = idetcd.waitSlot(ctx, idetcd.currentValue()); name == "" {
+				return
+			}
+		}
+		log.Infof("Claimed %s with lease %x", name, idetcd.currentLease())
+		idetcd.setState(stateClaimed)
+		idetcd.hold(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("Lost the ownership of %s", name)
+		idetcd.setState(stateRecovering)
+		name = idetcd.recoverSlot(ctx, name, idetcd.currentValue())
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+//hold keeps the lease of current node alive and watches the record of its slot, it returns once the lease has expired, the
+//record is deleted or taken by other lease, or ctx is done. The record is read before the watch starts, and the watch starts
+//right after that read, so changes made since the slot was claimed are not missed.
+func (idetcd *Idetcd) hold(ctx context.Context) {
+	r, id := idetcd.slot()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lease := idetcd.currentLease()
+	expired := idetcd.keepAlive(ctx, lease)
+	resp, err := idetcd.get(r.slotKey(id))
+	if err != nil || resp.Count == 0 || etcdcv3.LeaseID(resp.Kvs[0].Lease) != lease {
+		return
+	}
+	wch := idetcd.Client.Watch(ctx, r.slotKey(id), etcdcv3.WithRev(resp.Header.Revision+1))
+	for {
+		select {
+		case <-expired:
+			return
+		case resp, ok := <-wch:
+			if !ok || resp.Err() != nil {
+				return
+			}
+			for _, ev := range resp.Events {
+				if ev.Type == etcdcv3.EventTypeDelete || etcdcv3.LeaseID(ev.Kv.Lease) != lease {
+					return
+				}
+			}
+		}
+	}
+}
+
+//keepAlive renews the lease every renewal interval until ctx is done, the returned channel is closed once the lease has expired
+//or ctx is done. Failed renewals are retried in the next interval, as the lease may still be alive.
+func (idetcd *Idetcd) keepAlive(ctx context.Context, lease etcdcv3.LeaseID) <-chan struct{} {
+	expired := make(chan struct{})
+	go func() {
+		defer close(expired)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(idetcd.renewInterval()):
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, idetcd.timeout)
+			_, err := idetcd.Client.KeepAliveOnce(reqCtx, lease)
+			cancel()
+			if err == rpctypes.ErrLeaseNotFound {
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Warningf("Could not renew lease %x: %s", lease, authError(err))
+			}
+		}
+	}()
+	return expired
+}
+
+//renewInterval returns the interval until the next renewal of the lease, which is the renewal interval plus a random jitter.
+func (idetcd *Idetcd) renewInterval() time.Duration {
+	if idetcd.jitter <= 0 {
+		return idetcd.renew
+	}
+	return idetcd.renew + time.Duration(rand.Int63n(int64(idetcd.jitter)))
+}
+
+//recoverSlot tries to get the ownership of a slot back with exponential backoff until it succeeds or ctx is done. It returns the
+//domain name of the slot, or an empty string if there is no free slot for current node.
+func (idetcd *Idetcd) recoverSlot(ctx context.Context, name string, value string) string {
+	b := &backoff{}
+	for {
+		recovered, err := idetcd.reclaim(name, value)
+		if err == nil {
+			return recovered
+		}
+		log.Errorf("Could not take back the ownership of %s, retrying: %s", name, err)
+		if !b.retry(ctx) {
+			return ""
+		}
+	}
+}
+
+//reclaim tries to take the slot of current node back, or to take another free slot if it has been taken by other node. It returns
+//the domain name of the slot, or an empty string if there is no free slot for current node.
+func (idetcd *Idetcd) reclaim(name string, value string) (string, error) {
+	if err := idetcd.renewLease(); err != nil {
+		return "", err
+	}
+	lease := idetcd.currentLease()
+	r, id := idetcd.slot()
+	if id <= r.currentLimit() {
+		resp, err := idetcd.get(r.slotKey(id))
+		if err != nil {
+			return "", err
+		}
+		//The keepalive channel may be closed by a transient error while the record is still there.
+		if resp.Count != 0 && etcdcv3.LeaseID(resp.Kvs[0].Lease) == lease {
+			log.Infof("Still own %s with lease %x", name, lease)
+			return name, nil
+		}
+		reclaimed, err := idetcd.claimID(r, id, value, lease)
+		if err != nil {
+			return "", err
+		}
+		if reclaimed != "" {
+			log.Infof("Reclaimed %s with lease %x", reclaimed, lease)
+			return reclaimed, nil
+		}
+		log.Warningf("%s has been taken by another node", name)
+	}
+	changed, err := idetcd.claimSlot(value, lease)
+	if err != nil {
+		return "", err
+	}
+	if changed != "" {
+		log.Infof("Changed from %s to %s", name, changed)
+	}
+	return changed, nil
+}
+
+//renewLease makes sure that current node has a live lease, a new lease is granted if the previous one has expired.
+func (idetcd *Idetcd) renewLease() error {
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
+	defer cancel()
+	previous := idetcd.currentLease()
+	ttl, err := idetcd.Client.TimeToLive(ctx, previous)
+	if err != nil {
+		return authError(err)
+	}
+	if ttl.TTL > 0 {
+		return nil
+	}
+	lease, err := idetcd.grant()
+	if err != nil {
+		return err
+	}
+	if previous == 0 {
+		log.Infof("Granted lease %x", lease.ID)
+	} else {
+		log.Infof("Lease %x has expired, granted a new lease %x", previous, lease.ID)
+	}
+	idetcd.mu.Lock()
+	idetcd.lease = lease.ID
+	idetcd.mu.Unlock()
+	return nil
+}
+
+//release gives up the slot of current node by revoking its lease, so the record is deleted and the slot can be taken by other
+//nodes right away instead of after the lease expires. It gives up after the request timeout, e.g. when etcd is unreachable.
+func (idetcd *Idetcd) release() error {
+	//The node has never got a lease if etcd has been unreachable since startup.
+	lease := idetcd.currentLease()
+	if lease == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
+	defer cancel()
+	if _, err := idetcd.Client.Revoke(ctx, lease); err != nil {
+		return authError(err)
+	}
+	idetcd.mu.Lock()
+	if idetcd.ID != 0 {
+		log.Infof("Released slot %d of role %s", idetcd.ID, idetcd.role.name)
+	}
+	idetcd.ID = 0
+	idetcd.mu.Unlock()
+	idetcd.setState(stateReleased)
+	return nil
+}
@@ -0,0 +1,311 @@
+package idetcd
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/mholt/caddy"
+)
+
+//outageProxy is a tcp proxy in front of the local etcd instance, which can be cut off to simulate an etcd outage.
+type outageProxy struct {
+	listener net.Listener
+	mu       sync.Mutex
+	down     bool
+	conns    []net.Conn
+}
+
+func newOutageProxy(t *testing.T) *outageProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	p := &outageProxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			if p.down {
+				conn.Close()
+				p.mu.Unlock()
+				continue
+			}
+			upstream, err := net.Dial("tcp", "localhost:2379")
+			if err != nil {
+				conn.Close()
+				p.mu.Unlock()
+				continue
+			}
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func (p *outageProxy) endpoint() string { return "http://" + p.listener.Addr().String() }
+
+//cut closes all the connections to etcd, and refuses new ones until restore is called.
+func (p *outageProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = true
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *outageProxy) restore() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = false
+}
+
+func (p *outageProxy) close() {
+	p.cut()
+	p.listener.Close()
+}
+
+//startNode claims the first free slot with a node which talks to etcd through the endpoint, and runs its lifecycle until ctx is done.
+func startNode(ctx context.Context, t *testing.T, endpoint string) *Idetcd {
+	idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+			endpoint `+endpoint+`
+			pattern worker{{.ID}}.tf.local.
+			limit 5
+		}`))
+	if err != nil {
+		t.Fatalf("Could not parse the corefile: %s", err)
+	}
+	if err := idetc.connect(); err != nil {
+		t.Fatalf("Could not connect to etcd: %s", err)
+	}
+	lease, err := idetc.grant()
+	if err != nil {
+		t.Fatalf("Could not grant the lease: %s", err)
+	}
+	idetc.lease = lease.ID
+	idetc.value = "value"
+	name, err := idetc.claimSlot(idetc.value, idetc.lease)
+	if err != nil || name == "" {
+		t.Fatalf("Could not claim the slot: %v", err)
+	}
+	go idetc.run(ctx, name)
+	return idetc
+}
+
+//waitOwner waits until the key of the slot is attached to a lease other than the given one, and returns that lease.
+func waitOwner(t *testing.T, cli *clientv3.Client, key string, old clientv3.LeaseID, within time.Duration) clientv3.LeaseID {
+	deadline := time.Now().Add(within)
+	for time.Now().Before(deadline) {
+		resp, err := cli.Get(context.Background(), key)
+		if err == nil && resp.Count == 1 && clientv3.LeaseID(resp.Kvs[0].Lease) != old {
+			return clientv3.LeaseID(resp.Kvs[0].Lease)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be taken with a new lease within %s, got none", key, within)
+	return 0
+}
+
+func TestReclaimAfterLeaseExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := startNode(ctx, t, defaultEndpoint)
+	defer node.Client.Close()
+	r, id := node.slot()
+	old := node.lease
+
+	//Revoking the lease deletes the record just like the lease expires.
+	if _, err := node.Client.Revoke(context.Background(), old); err != nil {
+		t.Fatalf("Could not revoke the lease: %s", err)
+	}
+	waitOwner(t, node.Client, r.slotKey(id), old, 5*time.Second)
+	if current, currentID := node.slot(); current != r || currentID != id {
+		t.Errorf("Expected node to take slot %d back, got: %d", id, currentID)
+	}
+	deleteAll()
+}
+
+func TestChangeIDWhenTaken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := startNode(ctx, t, defaultEndpoint)
+	defer node.Client.Close()
+	r, id := node.slot()
+
+	//Another node takes the slot right after the lease of current node expires.
+	other, err := node.Client.Grant(context.Background(), int64(defaultTTL/time.Second))
+	if err != nil {
+		t.Fatalf("Could not grant the lease: %s", err)
+	}
+	if _, err := node.Client.Put(context.Background(), r.slotKey(id), "other", clientv3.WithLease(other.ID)); err != nil {
+		t.Fatalf("Could not take the slot: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, currentID := node.slot(); currentID != id {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	_, currentID := node.slot()
+	if currentID == id {
+		t.Fatalf("Expected node to move to another slot, but it still thinks it owns %d", id)
+	}
+	resp, err := node.get(r.slotKey(currentID))
+	if err != nil || resp.Count != 1 || clientv3.LeaseID(resp.Kvs[0].Lease) != node.lease {
+		t.Errorf("Expected node to own slot %d with lease %x, got: %v", currentID, node.lease, err)
+	}
+	deleteAll()
+}
+
+func TestRecoverAfterOutage(t *testing.T) {
+	proxy := newOutageProxy(t)
+	defer proxy.close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := startNode(ctx, t, proxy.endpoint())
+	defer node.Client.Close()
+	r, id := node.slot()
+	old := node.lease
+
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{defaultEndpoint}})
+	if err != nil {
+		t.Fatalf("Could not create the etcd client: %s", err)
+	}
+	defer cli.Close()
+
+	//Cut the node off from etcd for longer than the ttl, so its lease expires and the record is deleted.
+	proxy.cut()
+	time.Sleep(defaultTTL + 5*time.Second)
+	resp, err := cli.Get(context.Background(), r.slotKey(id))
+	if err != nil {
+		t.Fatalf("Could not get the record: %s", err)
+	}
+	if resp.Count != 0 {
+		t.Fatalf("Expected the record to expire during the outage, got: %s", resp.Kvs[0].Value)
+	}
+	proxy.restore()
+	waitOwner(t, cli, r.slotKey(id), old, defaultTTL)
+	deleteAll()
+}
+
+func TestReleaseOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	node := startNode(ctx, t, defaultEndpoint)
+	defer node.Client.Close()
+	r, id := node.slot()
+
+	cancel()
+	if err := node.release(); err != nil {
+		t.Fatalf("Could not release the slot: %s", err)
+	}
+	//The slot is free right away, instead of after the lease expires.
+	nextCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	next := startNode(nextCtx, t, defaultEndpoint)
+	defer next.Client.Close()
+	if current, nextID := next.slot(); current.name != r.name || nextID != id {
+		t.Errorf("Expected slot %d to be claimable right after release, got: %d", id, nextID)
+	}
+	deleteAll()
+}
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{}
+	previous := time.Duration(0)
+	for i := 0; i < 20; i++ {
+		delay := b.next()
+		if delay < minBackoff/2 || delay > maxBackoff {
+			t.Fatalf("Expected the delay between %s and %s, got: %s", minBackoff/2, maxBackoff, delay)
+		}
+		if b.delay < previous {
+			t.Fatalf("Expected the delay to grow, got %s after %s", b.delay, previous)
+		}
+		previous = b.delay
+	}
+	if b.delay != maxBackoff {
+		t.Errorf("Expected the delay to reach %s, got: %s", maxBackoff, b.delay)
+	}
+}
+
+//startInBackground starts a node which talks to etcd through the endpoint in the background, and returns the channel which the
+//result of the startup is sent on.
+func startInBackground(ctx context.Context, t *testing.T, endpoint string, settings string) (*Idetcd, chan error) {
+	idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+			endpoint `+endpoint+`
+			pattern worker{{.ID}}.tf.local.
+			limit 5
+			`+settings+`
+		}`))
+	if err != nil {
+		t.Fatalf("Could not parse the corefile: %s", err)
+	}
+	idetc.value = "value"
+	cache := newRecordCache(idetc)
+	idetc.store = cache
+	started := make(chan error)
+	go idetc.start(ctx, cache, started, make(chan struct{}))
+	return idetc, started
+}
+
+func TestStartWithoutEtcd(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	//Nothing listens on the endpoint.
+	listener.Close()
+	//The client authenticates as soon as it is created with credentials, which fails while etcd is unreachable.
+	for _, settings := range []string{"", "credentials idetcd secret"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		node, started := startInBackground(ctx, t, "http://"+listener.Addr().String(), settings)
+		select {
+		case err := <-started:
+			t.Fatalf("Expected the node to keep trying while etcd is unreachable with %q, got: %v", settings, err)
+		case <-time.After(2 * time.Second):
+		}
+		node.mu.RLock()
+		state := node.state
+		node.mu.RUnlock()
+		if state != stateConnecting {
+			t.Errorf("Expected the node to be %s with %q, got: %s", stateConnecting, settings, state)
+		}
+		cancel()
+	}
+}
+
+func TestClaimAfterEtcdComesUp(t *testing.T) {
+	proxy := newOutageProxy(t)
+	defer proxy.close()
+	proxy.cut()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node, started := startInBackground(ctx, t, proxy.endpoint(), "")
+
+	time.Sleep(2 * time.Second)
+	proxy.restore()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Expected the node to claim a slot, got: %s", err)
+		}
+	case <-time.After(maxBackoff + 5*time.Second):
+		t.Fatalf("Expected the node to claim a slot once etcd comes up")
+	}
+	if _, id := node.slot(); id == 0 {
+		t.Errorf("Expected the node to own a slot")
+	}
+	deleteAll()
+}
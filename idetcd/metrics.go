@@ -0,0 +1,47 @@
+package idetcd
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	staleAnswers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "idetcd",
+		Name:      "stale_answers_total",
+		Help:      "Counter of answers served from the records in memory while etcd is unreachable.",
+	})
+
+	staleSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "idetcd",
+		Name:      "stale_seconds",
+		Help:      "Seconds since etcd became unreachable, the records in memory may be stale. 0 while etcd is reachable.",
+	})
+
+	addressChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "idetcd",
+		Name:      "address_changes_total",
+		Help:      "Counter of changes of the addresses which current node publishes in its record.",
+	})
+
+	stateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "idetcd",
+		Name:      "state",
+		Help:      "State of current node, 1 for the current state and 0 for the others.",
+	}, []string{"state"})
+
+	retries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "idetcd",
+		Name:      "retries_total",
+		Help:      "Counter of retries of the requests to etcd which have failed while connecting, claiming or recovering a slot.",
+	})
+)
+
+var once sync.Once
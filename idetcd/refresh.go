@@ -0,0 +1,105 @@
+package idetcd
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+)
+
+//defaultRefresh is how often the addresses of current node are computed again.
+const defaultRefresh = 30 * time.Second
+
+//localValue returns the record of current node with its current addresses in json format.
+func (idetcd *Idetcd) localValue() (string, error) {
+	host, err := idetcd.selector.record()
+	if err != nil {
+		return "", err
+	}
+	host.Port = idetcd.port
+	host.Fingerprint = idetcd.fingerprint
+	value, err := json.Marshal(host)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+//currentValue returns the record which current node puts in its slot.
+func (idetcd *Idetcd) currentValue() string {
+	idetcd.mu.RLock()
+	defer idetcd.mu.RUnlock()
+	return idetcd.value
+}
+
+//refreshValue computes the addresses of current node again, and returns the new record if it has changed.
+func (idetcd *Idetcd) refreshValue() (string, bool, error) {
+	value, err := idetcd.localValue()
+	if err != nil {
+		return "", false, err
+	}
+	idetcd.mu.Lock()
+	defer idetcd.mu.Unlock()
+	if value == idetcd.value {
+		return value, false, nil
+	}
+	log.Infof("The record of current node changed from %s to %s", idetcd.value, value)
+	idetcd.value = value
+	return value, true, nil
+}
+
+//watchAddresses computes the addresses of current node every refresh interval until ctx is done, and updates the record in its
+//slot once they change. If the update fails, e.g. etcd is unreachable, it is tried again in the next interval.
+func (idetcd *Idetcd) watchAddresses(ctx context.Context) {
+	published := idetcd.currentValue()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(idetcd.refresh):
+		}
+		value, changed, err := idetcd.refreshValue()
+		if err != nil {
+			log.Errorf("Could not get the addresses of current node: %s", err)
+			continue
+		}
+		if changed {
+			addressChanges.Inc()
+		}
+		if value == published {
+			continue
+		}
+		ok, err := idetcd.update(value)
+		if err != nil {
+			log.Errorf("Could not update the record of current node: %s", err)
+			continue
+		}
+		//If current node does not own its slot right now, the new record is put once it takes a slot again.
+		if ok {
+			r, id := idetcd.slot()
+			log.Infof("Updated the record of slot %d of role %s", id, r.name)
+			published = value
+		}
+	}
+}
+
+//update puts the record in the slot of current node under its lease, only if current node still owns the slot. It returns false
+//if current node does not own any slot.
+func (idetcd *Idetcd) update(value string) (bool, error) {
+	r, id := idetcd.slot()
+	if id == 0 {
+		return false, nil
+	}
+	key, lease := r.slotKey(id), idetcd.currentLease()
+	ctx, cancel := context.WithTimeout(idetcd.Ctx, idetcd.timeout)
+	defer cancel()
+	resp, err := idetcd.Client.Txn(ctx).
+		If(etcdcv3.Compare(etcdcv3.LeaseValue(key), "=", lease)).
+		Then(etcdcv3.OpPut(key, value, etcdcv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return false, authError(err)
+	}
+	return resp.Succeeded, nil
+}
@@ -0,0 +1,96 @@
+package idetcd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//advertiseFile makes the node advertise the address in a file, which can be changed by the test.
+func advertiseFile(t *testing.T, idetc *Idetcd, addr string) string {
+	dir, err := ioutil.TempDir("", "idetcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	path := filepath.Join(dir, "address")
+	writeAddress(t, path, addr)
+	idetc.selector.advertise, err = newAdvertiser([]string{"file", path})
+	if err != nil {
+		t.Fatalf("Could not advertise the file: %s", err)
+	}
+	return path
+}
+
+func writeAddress(t *testing.T, path string, addr string) {
+	if err := ioutil.WriteFile(path, []byte(addr+"\n"), 0644); err != nil {
+		t.Fatalf("Could not write the address: %s", err)
+	}
+}
+
+func TestRefreshValue(t *testing.T) {
+	idetc := &Idetcd{port: "2222"}
+	path := advertiseFile(t, idetc, "203.0.113.7")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	value, changed, err := idetc.refreshValue()
+	if err != nil || !changed {
+		t.Fatalf("Expected the first record to be a change, got: %t, %v", changed, err)
+	}
+	if !strings.Contains(value, "203.0.113.7") || idetc.currentValue() != value {
+		t.Errorf("Expected the record with 203.0.113.7, got: %s", idetc.currentValue())
+	}
+	if _, changed, _ := idetc.refreshValue(); changed {
+		t.Errorf("Expected no change while the addresses are the same")
+	}
+
+	writeAddress(t, path, "203.0.113.8")
+	value, changed, err = idetc.refreshValue()
+	if err != nil || !changed || !strings.Contains(value, "203.0.113.8") {
+		t.Errorf("Expected the record to change to 203.0.113.8, got: %s, %t, %v", value, changed, err)
+	}
+
+	//The record is kept if the addresses can not be read.
+	os.Remove(path)
+	if _, _, err := idetc.refreshValue(); err == nil {
+		t.Errorf("Expected an error once the address file is gone")
+	}
+	if !strings.Contains(idetc.currentValue(), "203.0.113.8") {
+		t.Errorf("Expected the record to be kept, got: %s", idetc.currentValue())
+	}
+}
+
+func TestUpdateRecordOnAddressChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := startNode(ctx, t, defaultEndpoint)
+	defer node.Client.Close()
+	r, id := node.slot()
+	path := advertiseFile(t, node, "203.0.113.7")
+	defer os.RemoveAll(filepath.Dir(path))
+	node.refresh = 100 * time.Millisecond
+	go node.watchAddresses(ctx)
+
+	for _, addr := range []string{"203.0.113.7", "203.0.113.8"} {
+		writeAddress(t, path, addr)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := node.get(r.slotKey(id))
+			if err == nil && resp.Count == 1 && strings.Contains(string(resp.Kvs[0].Value), addr) {
+				//The record is updated under the same lease, so the slot is kept.
+				if lease := resp.Kvs[0].Lease; lease != int64(node.lease) {
+					t.Errorf("Expected the record to stay with lease %x, got: %x", node.lease, lease)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the record of slot %d to be updated to %s", id, addr)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	deleteAll()
+}
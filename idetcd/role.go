@@ -0,0 +1,183 @@
+package idetcd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	//defaultRole is the name of the role which is declared by pattern and limit in the Corefile.
+	defaultRole = "default"
+	//assignPriority means that the node takes a slot of the roles in the order they are declared.
+	assignPriority = "priority"
+	//roleEnv is the environment variable which picks the role of the node if it is not assigned in the Corefile.
+	roleEnv = "IDETCD_ROLE"
+	//keyRoot is the common prefix of all the keys idetcd saves in the etcd.
+	keyRoot = "/idetcd/"
+)
+
+//role is a kind of nodes in the cluster, e.g. ps, worker or chief in distributed TensorFlow. Every role has its own domain name
+//pattern and limit, and its slots are saved in the etcd under its own prefix.
+type role struct {
+	name string
+	//configKey is the key where the cluster-wide configuration of the role is saved in the etcd.
+	configKey string
+	//corefileLimit is the limit in the Corefile, it is used if the limit is not set in the cluster-wide configuration.
+	corefileLimit int
+	//mu protects limit, which can be changed by the cluster-wide configuration at runtime, and pattern, which is replaced by the
+	//cluster-wide configuration at startup while DNS queries are already answered.
+	mu      sync.RWMutex
+	limit   int
+	pattern *rolePattern
+}
+
+//rolePattern is the parsed domain name pattern of a role, it is never modified once it is set in the role.
+type rolePattern struct {
+	template *template.Template
+	//text is the text of the domain name pattern.
+	text string
+	//prefix is the common prefix of the keys idetcd saves in etcd for the pattern.
+	prefix string
+	//nameParts are the parts of the lower-cased domain name pattern before and after the id.
+	nameParts [2]string
+	//zone is the zone of the domain names of the slots, idetcd answers authoritatively for the names in it.
+	zone string
+}
+
+//newRole returns a role with the domain name pattern and the limit in the Corefile.
+func newRole(name string, pattern string, limit int) (*role, error) {
+	r := &role{name: name, limit: limit, corefileLimit: limit}
+	if err := r.setPattern(pattern); err != nil {
+		return nil, err
+	}
+	r.configKey = r.pattern.prefix + "config"
+	return r, nil
+}
+
+//setPattern parses the domain name pattern, and sets the prefix of the keys which are saved in the etcd for it.
+func (r *role) setPattern(text string) error {
+	pattern, err := parsePattern(text)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pattern = pattern
+	r.mu.Unlock()
+	return nil
+}
+
+//parsePattern parses the domain name pattern, and finds the prefix of the keys which are saved in the etcd for it.
+func parsePattern(text string) (*rolePattern, error) {
+	tmpl, err := template.New("idetcd").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	prefix, nameParts, err := keyPrefix(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return &rolePattern{template: tmpl, text: text, prefix: prefix, nameParts: nameParts, zone: patternZone(nameParts)}, nil
+}
+
+//currentPattern returns the domain name pattern of the role which is currently applied.
+func (r *role) currentPattern() *rolePattern {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pattern
+}
+
+//currentLimit returns the limit of the role which is currently applied.
+func (r *role) currentLimit() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.limit
+}
+
+//domainName returns the domain name of the slot with the given id.
+func (r *role) domainName(id int) (string, error) {
+	var namebuf bytes.Buffer
+	if err := r.currentPattern().template.Execute(&namebuf, struct{ ID int }{id}); err != nil {
+		return "", err
+	}
+	return namebuf.String(), nil
+}
+
+//slotPrefix returns the common prefix of the keys of all the slots.
+func (r *role) slotPrefix() string {
+	return r.currentPattern().prefix + "slots/"
+}
+
+//slotKey returns the key where the record of the slot with the given id is saved.
+func (r *role) slotKey(id int) string {
+	return r.slotPrefix() + strconv.Itoa(id)
+}
+
+//slotID returns the id of the slot which the domain name belongs to, the domain name should be lower-cased.
+func (r *role) slotID(name string) (int, bool) {
+	nameParts := r.currentPattern().nameParts
+	if !strings.HasPrefix(name, nameParts[0]) || !strings.HasSuffix(name, nameParts[1]) ||
+		len(name) <= len(nameParts[0])+len(nameParts[1]) {
+		return 0, false
+	}
+	s := name[len(nameParts[0]) : len(name)-len(nameParts[1])]
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 1 || strconv.Itoa(id) != s {
+		return 0, false
+	}
+	return id, true
+}
+
+//waiterPrefix returns the common prefix of the keys of all the nodes which are waiting for a slot of the role.
+func (r *role) waiterPrefix() string {
+	return r.currentPattern().prefix + "waiters/"
+}
+
+//fingerprintKey returns the key where the id held by the fingerprint in the role is saved.
+func (r *role) fingerprintKey(fingerprint string) string {
+	return r.currentPattern().prefix + "nodes/" + fingerprint
+}
+
+//findRole returns the role with the given name, or nil if there is none.
+func findRole(roles []*role, name string) *role {
+	for _, r := range roles {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+//assignRole returns the role the node should take, which is picked by the assign directive, or by the environment variable if
+//it is not in the Corefile. An empty string means that the node takes a slot of the roles in priority order.
+func assignRole(roles []*role, assign string) (string, error) {
+	if assign == "" {
+		assign = os.Getenv(roleEnv)
+	}
+	if assign == "" || assign == assignPriority {
+		return "", nil
+	}
+	if findRole(roles, assign) == nil {
+		return "", fmt.Errorf("unknown role: %s", assign)
+	}
+	return assign, nil
+}
+
+//keyPrefix returns the common prefix of the keys saved in the etcd for the pattern, and the parts of the lower-cased pattern
+//before and after the id.
+func keyPrefix(pattern *template.Template) (string, [2]string, error) {
+	var buf bytes.Buffer
+	if err := pattern.Execute(&buf, struct{ ID string }{"*"}); err != nil {
+		return "", [2]string{}, err
+	}
+	glob := strings.ToLower(buf.String())
+	if strings.Count(glob, "*") != 1 {
+		return "", [2]string{}, fmt.Errorf("pattern should contain the id exactly once")
+	}
+	parts := strings.SplitN(glob, "*", 2)
+	return keyRoot + glob + "/", [2]string{parts[0], parts[1]}, nil
+}
@@ -0,0 +1,175 @@
+package idetcd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestSlotID(t *testing.T) {
+	c := caddy.NewTestController("dns", `idetcd {
+			pattern Worker{{.ID}}.tf.local.
+		}`)
+	idetc, err := idetcdParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse the corefile: %s", err)
+	}
+	r := idetc.roles[0]
+	if r.currentPattern().prefix != "/idetcd/worker*.tf.local./" {
+		t.Errorf("Expected prefix /idetcd/worker*.tf.local./, got: %s", r.currentPattern().prefix)
+	}
+	tests := []struct {
+		name       string
+		expectedID int
+		expectedOk bool
+	}{
+		{"worker1.tf.local.", 1, true},
+		{"worker12.tf.local.", 12, true},
+		{"worker01.tf.local.", 0, false},
+		{"worker0.tf.local.", 0, false},
+		{"worker.tf.local.", 0, false},
+		{"workerx.tf.local.", 0, false},
+		{"ps1.tf.local.", 0, false},
+		{"worker1.tf.local.com.", 0, false},
+		{"google.com.", 0, false},
+	}
+	for i, test := range tests {
+		id, ok := r.slotID(test.name)
+		if id != test.expectedID || ok != test.expectedOk {
+			t.Errorf("Test %d: Expected (%d, %t) for %s, got: (%d, %t)", i, test.expectedID, test.expectedOk, test.name, id, ok)
+		}
+	}
+}
+
+func TestPatternWithoutID(t *testing.T) {
+	for _, pattern := range []string{"worker.tf.local.", "worker{{.ID}}-{{.ID}}.tf.local."} {
+		c := caddy.NewTestController("dns", `idetcd {
+			pattern `+pattern+`
+		}`)
+		if _, err := idetcdParse(c); err == nil {
+			t.Errorf("Expected error but found none for pattern %s", pattern)
+		}
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	tests := []struct {
+		input          string
+		env            string
+		shouldErr      bool
+		expectedRoles  []string
+		expectedLimits []int
+		expectedAssign string
+	}{
+		{`idetcd {
+			pattern worker{{.ID}}.tf.local.
+			limit 5
+		}`, "", false, []string{defaultRole}, []int{5}, ""},
+		{`idetcd {
+			role chief chief{{.ID}}.tf.local. 1
+			role ps ps{{.ID}}.tf.local. 2
+			role worker worker{{.ID}}.tf.local. 8
+		}`, "", false, []string{"chief", "ps", "worker"}, []int{1, 2, 8}, ""},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local. 2
+			role worker worker{{.ID}}.tf.local. 8
+			assign worker
+		}`, "ps", false, []string{"ps", "worker"}, []int{2, 8}, "worker"},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local. 2
+			role worker worker{{.ID}}.tf.local. 8
+		}`, "ps", false, []string{"ps", "worker"}, []int{2, 8}, "ps"},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local. 2
+			role worker worker{{.ID}}.tf.local. 8
+			assign priority
+		}`, "ps", false, []string{"ps", "worker"}, []int{2, 8}, ""},
+		{`idetcd {
+			pattern chief{{.ID}}.tf.local.
+			limit 1
+			role worker worker{{.ID}}.tf.local. 8
+		}`, "", false, []string{defaultRole, "worker"}, []int{1, 8}, ""},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local. 2
+			assign worker
+		}`, "", true, nil, nil, ""},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local. 2
+			role ps ps{{.ID}}.tf.local. 2
+		}`, "", true, nil, nil, ""},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local. 2
+			role worker PS{{.ID}}.tf.local. 8
+		}`, "", true, nil, nil, ""},
+		{`idetcd {
+			pattern worker{{.ID}}.tf.local.
+			role worker worker{{.ID}}.tf.local. 8
+		}`, "", true, nil, nil, ""},
+		{`idetcd {
+			role ps ps{{.ID}}.tf.local.
+		}`, "", true, nil, nil, ""},
+		{`idetcd {
+			role ps ps.tf.local. 2
+		}`, "", true, nil, nil, ""},
+	}
+	defer os.Unsetenv(roleEnv)
+	for i, test := range tests {
+		os.Setenv(roleEnv, test.env)
+		idetc, err := idetcdParse(caddy.NewTestController("dns", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+			continue
+		}
+		if len(idetc.roles) != len(test.expectedRoles) {
+			t.Errorf("Test %d: Expected roles %v, got %d roles", i, test.expectedRoles, len(idetc.roles))
+			continue
+		}
+		for j, r := range idetc.roles {
+			if r.name != test.expectedRoles[j] || r.limit != test.expectedLimits[j] {
+				t.Errorf("Test %d: Expected role %s with limit %d, got: %s with limit %d", i, test.expectedRoles[j], test.expectedLimits[j], r.name, r.limit)
+			}
+		}
+		if idetc.assign != test.expectedAssign {
+			t.Errorf("Test %d: Expected assigned role %q, got: %q", i, test.expectedAssign, idetc.assign)
+		}
+	}
+}
+
+func TestFillRolesInPriorityOrder(t *testing.T) {
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			role ps ps{{.ID}}.tf.local. 1
+			role worker worker{{.ID}}.tf.local. 2
+			assign priority
+		}`
+	expected := []string{"ps1.tf.local.", "worker1.tf.local.", "worker2.tf.local.", ""}
+	for i, name := range expected {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("Could not parse the corefile: %s", err)
+		}
+		if err := idetc.connect(); err != nil {
+			t.Fatalf("Could not connect to etcd: %s", err)
+		}
+		defer idetc.Client.Close()
+		lease, err := idetc.grant()
+		if err != nil {
+			t.Fatalf("Could not grant the lease: %s", err)
+		}
+		claimed, err := idetc.claimSlot("value", lease.ID)
+		if err != nil {
+			t.Fatalf("Could not claim the slot for node %d: %s", i, err)
+		}
+		if claimed != name {
+			t.Errorf("Expected node %d to take %q, got: %q", i, name, claimed)
+		}
+	}
+	deleteAll()
+}
@@ -1,10 +1,9 @@
 package idetcd
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"net"
+	"crypto/tls"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
@@ -12,6 +11,9 @@ import (
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	mwtls "github.com/coredns/coredns/plugin/pkg/tls"
 	etcdcv3 "github.com/coreos/etcd/clientv3"
 
 	"github.com/mholt/caddy"
@@ -19,8 +21,14 @@ import (
 
 const (
 	defaultEndpoint = "http://localhost:2379"
-	defaultTTL      = 20
+	defaultTTL      = 20 * time.Second
 	defaultLimit    = 10
+	defaultTimeout  = 5 * time.Second
+	defaultMaxStale = 10 * time.Minute
+	//defaultAnswerTTL is the ttl of the answers, it is short so resolvers notice the changes of the slots soon.
+	defaultAnswerTTL = 5 * time.Second
+	//defaultStartupTimeout is how long the startup waits for the node to claim a slot.
+	defaultStartupTimeout = 10 * time.Second
 )
 
 func init() {
@@ -42,81 +50,66 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("idetcd", c.ArgErr())
 	}
 
-	//killChan is a channel used for integration tests.
-	var (
-		namebuf  bytes.Buffer
-		killChan chan struct{}
-		id       = 1
-	)
-
-	//get ipv4, ipv6 and port.
-	host := iP()
-	host.Port = dnsserver.GetConfig(c).Port
+	//ServeDNS answers from the records in memory, which are kept current by watching the slots in the etcd.
+	cache := newRecordCache(idetc)
+	idetc.store = cache
 
-	//put them in json format.
-	localIP, err := json.Marshal(host)
+	//get the selected addresses and port in json format.
+	if idetc.port == "" {
+		idetc.port = dnsserver.GetConfig(c).Port
+	}
+	value, err := idetc.localValue()
 	if err != nil {
 		return plugin.Error("idetcd", err)
 	}
-	value := string(localIP)
-	killChan = make(chan struct{})
-
-	//Try to find a free slot for current node
-	for id <= idetc.limit {
-		idetc.ID = id
-		idetc.pattern.Execute(&namebuf, idetc)
-		name := namebuf.String()
+	idetc.value = value
 
-		//Try to see if it can find the proposed domain name in the etcd
-		resp, err := idetc.get(name)
-		if err != nil {
-			return err
-		}
+	//Connect to etcd and claim a slot in the background, so the node keeps trying while etcd is slow to come up. Keep the lease
+	//alive, so the record of current node stays in etcd as long as the node is alive, and it is deleted by etcd once the node is
+	//gone and the lease expires after ttl. If the node loses its slot while it is alive, it takes a slot back.
+	ctx, cancel := context.WithCancel(idetc.Ctx)
+	started := make(chan error)
+	detached := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		idetc.start(ctx, cache, started, detached)
+		close(done)
+	}()
 
-		if resp.Count == 0 {
-			//Can not find the proposed domain name in the etcd, so the node take this domain name, and put the record attached a lease with ttl in etcd.
-			lease, _ := idetc.Client.Grant(context.TODO(), defaultTTL)
-			idetc.set(name, value, etcdcv3.WithLease(lease.ID))
-			break
-		} else {
-			//Node find the proposed domain name is already used by other node, so it increases the proposed id and try another domain name.
-			id++
-			namebuf.Reset()
+	//The startup waits for the node to claim a slot until the startup timeout. If node can not find a free slot until it proposed
+	//id is bigger than the limit, then just stop the coredns server, unless it is configured to wait for a free slot.
+	select {
+	case err := <-started:
+		if err == errFull {
+			cancel()
+			<-done
+			idetc.release()
+			return plugin.Error("idetcd", c.Errf("Could not have more than %s nodes in you cluster.", idetc.limits()))
 		}
+	case <-time.After(idetc.startupTimeout):
+		log.Warningf("Could not claim a slot within %s, keep trying in the background", idetc.startupTimeout)
+		close(detached)
 	}
 
-	//If node can not find a free slot until it proposed id is bigger than the limit, then just stop the coredns server.
-	if id > idetc.limit {
-		return plugin.Error("idetcd", c.Errf("Could not have more than %d nodes in you cluster.", idetc.limit))
-	}
-
-	//update the record in the etcd
-	//Here node renew its own record in etcd periodly.Every time the node want to renew record, it should first get its previous record in etcd, and compare it with
-	//the record it has locally, if they are the same, then the node update it.
-	//Notice that the period is smaller than ttl, this is because if the period is exactly the ttl, sometimes the record can be deleted by the etcd before node
-	//updates since communicating with etcd also needs some time.
-	renewTicker := time.NewTicker(defaultTTL / 2 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-renewTicker.C:
-				resp, err := idetc.get(namebuf.String())
-				if err != nil {
-					return
-				}
-				if string(resp.Kvs[0].Value) == value {
-					lease, _ := idetc.Client.Grant(context.TODO(), defaultTTL)
-					idetc.set(namebuf.String(), value, etcdcv3.WithLease(lease.ID))
-				}
-			case <-killChan:
-				namebuf.Reset()
-				return
-			}
+	//Release the slot on graceful shutdown, so other nodes can take it right away. The lifecycle of the slot is stopped first,
+	//so it does not take the slot back, and the shutdown is bounded by the request timeout when etcd is down.
+	idetc.shutdown = func() error {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(idetc.timeout):
 		}
-	}()
+		if err := idetc.release(); err != nil {
+			log.Errorf("Could not release the slot: %s", err)
+		}
+		return nil
+	}
+	c.OnShutdown(idetc.shutdown)
 
-	c.OnShutdown(func() error {
-		close(killChan)
+	c.OnStartup(func() error {
+		once.Do(func() {
+			metrics.MustRegister(c, staleAnswers, staleSeconds, addressChanges, stateGauge, retries)
+		})
 		return nil
 	})
 
@@ -127,32 +120,6 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
-//Get the both ipv4 and ipv6 local address(in Record format) of the interface which is the first one after loopback interface.
-func iP() Record {
-	record := new(Record)
-	interfaces, _ := net.Interfaces()
-	var flag bool
-	for _, inter := range interfaces {
-		if inter.Flags&net.FlagLoopback == 0 {
-			flag = false
-			addrs, _ := inter.Addrs()
-			for _, addr := range addrs {
-				localIP := net.ParseIP(strings.Split(addr.String(), "/")[0])
-				if localIP.To4() != nil {
-					record.Ipv4 = localIP.String()
-					flag = true
-				} else if localIP.To16() != nil {
-					record.Ipv6 = localIP.To16().String()
-				}
-			}
-			if flag {
-				break
-			}
-		}
-	}
-	return *record
-}
-
 //Parsing the Corefile.
 func idetcdParse(c *caddy.Controller) (*Idetcd, error) {
 	idetc := Idetcd{
@@ -160,11 +127,37 @@ func idetcdParse(c *caddy.Controller) (*Idetcd, error) {
 	}
 	var (
 		endpoints = []string{defaultEndpoint}
-		pattern   = template.New("idetcd")
+		pattern   string
 		limit     = defaultLimit
+		roles     []*role
+		assign    string
+		finger    string
+		configKey string
+		whenFull  = whenFullFail
+		maxWait   time.Duration
+		ttl       = defaultTTL
+		answerTTL = time.Duration(-1)
+		renew     time.Duration
+		jitter    time.Duration
+		timeout   = defaultTimeout
+		dial      time.Duration
+		port      string
+		selector  addrSelector
+		tlsConfig *tls.Config
+		startup   = defaultStartupTimeout
+		username  string
+		password  string
+		refresh   = defaultRefresh
+		maxStale  time.Duration
+		zones     []string
+		fallthru  fall.F
 		err       error
 	)
 	for c.Next() {
+		zones = c.RemainingArgs()
+		for i := range zones {
+			zones[i] = plugin.Host(zones[i]).Normalize()
+		}
 		for c.NextBlock() {
 			switch c.Val() {
 			case "endpoint":
@@ -178,10 +171,10 @@ func idetcdParse(c *caddy.Controller) (*Idetcd, error) {
 				if len(args) != 1 {
 					return &Idetcd{}, c.ArgErr()
 				}
-				pattern, err = pattern.Parse(args[0])
-				if err != nil {
+				if _, err = template.New("idetcd").Parse(args[0]); err != nil {
 					return &Idetcd{}, c.ArgErr()
 				}
+				pattern = args[0]
 			case "limit":
 				args := c.RemainingArgs()
 				if len(args) != 1 {
@@ -191,29 +184,308 @@ func idetcdParse(c *caddy.Controller) (*Idetcd, error) {
 				if err != nil {
 					return &Idetcd{}, c.ArgErr()
 				}
+			case "role":
+				args := c.RemainingArgs()
+				if len(args) != 3 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				roleLimit, err := strconv.Atoi(args[2])
+				if err != nil {
+					return &Idetcd{}, c.ArgErr()
+				}
+				if args[0] == defaultRole || args[0] == assignPriority || findRole(roles, args[0]) != nil {
+					return &Idetcd{}, c.Errf("duplicate or reserved role name: %s", args[0])
+				}
+				r, err := newRole(args[0], args[1], roleLimit)
+				if err != nil {
+					return &Idetcd{}, c.Errf("invalid pattern of role %s: %s", args[0], err)
+				}
+				roles = append(roles, r)
+			case "assign":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				assign = args[0]
+			case "when_full":
+				args := c.RemainingArgs()
+				if len(args) != 1 || (args[0] != whenFullFail && args[0] != whenFullWait) {
+					return &Idetcd{}, c.ArgErr()
+				}
+				whenFull = args[0]
+			case "max_wait":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				maxWait, err = time.ParseDuration(args[0])
+				if err != nil || maxWait < 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+			case "ttl":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				ttl, err = time.ParseDuration(args[0])
+				//The ttl of etcd leases is in seconds.
+				if err != nil || ttl < time.Second || ttl%time.Second != 0 {
+					return &Idetcd{}, c.Errf("ttl should be a whole number of seconds: %s", args[0])
+				}
+			case "answer_ttl":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				answerTTL, err = time.ParseDuration(args[0])
+				//The ttl of dns records is in seconds.
+				if err != nil || answerTTL < 0 || answerTTL%time.Second != 0 {
+					return &Idetcd{}, c.Errf("answer ttl should be a whole number of seconds: %s", args[0])
+				}
+			case "renew":
+				args := c.RemainingArgs()
+				if len(args) != 1 && len(args) != 2 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				renew, err = time.ParseDuration(args[0])
+				if err != nil || renew <= 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				if len(args) == 2 {
+					jitter, err = time.ParseDuration(args[1])
+					if err != nil || jitter < 0 {
+						return &Idetcd{}, c.ArgErr()
+					}
+				}
+			case "timeout":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				timeout, err = time.ParseDuration(args[0])
+				if err != nil || timeout <= 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+			case "dial_timeout":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				dial, err = time.ParseDuration(args[0])
+				if err != nil || dial <= 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+			case "fallthrough":
+				fallthru.SetZonesFromArgs(c.RemainingArgs())
+			case "serve_stale":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				maxStale = defaultMaxStale
+				if len(args) == 1 {
+					maxStale, err = time.ParseDuration(args[0])
+					if err != nil || maxStale <= 0 {
+						return &Idetcd{}, c.ArgErr()
+					}
+				}
+			case "port":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				if n, err := strconv.Atoi(args[0]); err != nil || n < 1 || n > 65535 {
+					return &Idetcd{}, c.Errf("invalid port: %s", args[0])
+				}
+				port = args[0]
+			case "interfaces":
+				selector.interfaces = c.RemainingArgs()
+				if len(selector.interfaces) == 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				for _, pattern := range selector.interfaces {
+					if _, err := filepath.Match(pattern, ""); err != nil {
+						return &Idetcd{}, c.Errf("invalid interface pattern: %s", pattern)
+					}
+				}
+			case "advertise":
+				selector.advertise, err = newAdvertiser(c.RemainingArgs())
+				if err != nil {
+					return &Idetcd{}, c.Errf("%s", err)
+				}
+			case "tls": // cert key cacertfile
+				tlsConfig, err = mwtls.NewTLSConfigFromArgs(c.RemainingArgs()...)
+				if err != nil {
+					return &Idetcd{}, c.Errf("%s", err)
+				}
+			case "startup_timeout":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				startup, err = time.ParseDuration(args[0])
+				if err != nil || startup < 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+			case "credentials":
+				username, password, err = credentials(c.RemainingArgs())
+				if err != nil {
+					return &Idetcd{}, c.Errf("%s", err)
+				}
+			case "address_refresh":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				refresh, err = time.ParseDuration(args[0])
+				if err != nil || refresh < 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+			case "networks", "exclude_networks", "prefer":
+				directive := c.Val()
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				networks, err := parseNetworks(args)
+				if err != nil {
+					return &Idetcd{}, c.Errf("%s", err)
+				}
+				switch directive {
+				case "networks":
+					selector.networks = networks
+				case "exclude_networks":
+					selector.exclude = networks
+				default:
+					selector.prefer = networks
+				}
+			case "config":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				configKey = args[0]
+			case "fingerprint":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return &Idetcd{}, c.ArgErr()
+				}
+				finger, err = fingerprint(args[0], args[1:]...)
+				if err != nil {
+					return &Idetcd{}, c.Errf("could not get the fingerprint: %s", err)
+				}
 			}
 		}
 	}
-	client, err := newEtcdClient(endpoints)
+	//pattern and limit declare the default role, which comes before the other roles.
+	if pattern != "" || len(roles) == 0 {
+		r, err := newRole(defaultRole, pattern, limit)
+		if err != nil {
+			return &Idetcd{}, c.Errf("invalid pattern: %s", err)
+		}
+		if configKey != "" {
+			r.configKey = configKey
+		}
+		roles = append([]*role{r}, roles...)
+	}
+	//The roles with the same pattern would share their slots in the etcd and enforce different limits on them.
+	prefixes := make(map[string]string, len(roles))
+	for _, r := range roles {
+		prefix := r.currentPattern().prefix
+		if other, ok := prefixes[prefix]; ok {
+			return &Idetcd{}, c.Errf("roles %s and %s have the same pattern", other, r.name)
+		}
+		prefixes[prefix] = r.name
+	}
+	//The etcd client only talks TLS to the https endpoints, so the tls settings would be ignored for the others.
+	if tlsConfig != nil {
+		for _, endpoint := range endpoints {
+			if !strings.HasPrefix(endpoint, "https://") {
+				return &Idetcd{}, c.Errf("tls needs https endpoints, got: %s", endpoint)
+			}
+		}
+	}
+	//The advertised addresses replace the ones of the local interfaces, so they are not filtered.
+	if selector.advertise != nil && (len(selector.interfaces) != 0 || len(selector.networks) != 0 || len(selector.exclude) != 0 || len(selector.prefer) != 0) {
+		return &Idetcd{}, c.Errf("advertise can not be used with interfaces, networks, exclude_networks or prefer")
+	}
+	//The lease is renewed a few times within its ttl by default, like the keepalive of the etcd client does.
+	if renew == 0 {
+		renew = ttl / 3
+	}
+	if renew+jitter >= ttl {
+		return &Idetcd{}, c.Errf("renewal interval %s with jitter %s should be below the ttl %s", renew, jitter, ttl)
+	}
+	//Resolvers should not cache a record for longer than its owner may be gone, which is the ttl of the lease.
+	if answerTTL < 0 {
+		answerTTL = defaultAnswerTTL
+		if answerTTL > ttl {
+			answerTTL = ttl
+		}
+	}
+	if answerTTL > ttl {
+		return &Idetcd{}, c.Errf("answer ttl %s should not be above the ttl %s", answerTTL, ttl)
+	}
+	assign, err = assignRole(roles, assign)
 	if err != nil {
-		return &Idetcd{}, err
+		return &Idetcd{}, c.Errf("%s", err)
 	}
+	etcdCfg := etcdConfig(endpoints, dial, tlsConfig)
+	etcdCfg.Username = username
+	etcdCfg.Password = password
 	idetc.endpoints = endpoints
-	idetc.Client = client
-	idetc.pattern = pattern
-	idetc.limit = limit
+	idetc.clientConfig = etcdCfg
+	idetc.roles = roles
+	idetc.assign = assign
+	idetc.fingerprint = finger
+	idetc.whenFull = whenFull
+	idetc.maxWait = maxWait
+	idetc.ttl = ttl
+	idetc.answerTTL = uint32(answerTTL / time.Second)
+	idetc.renew = renew
+	idetc.jitter = jitter
+	idetc.timeout = timeout
+	idetc.store = etcdStore{&idetc}
+	idetc.port = port
+	idetc.selector = selector
+	idetc.refresh = refresh
+	idetc.startupTimeout = startup
+	idetc.maxStale = maxStale
+	idetc.zones = zones
+	idetc.fall = fallthru
 	return &idetc, nil
 
 }
 
-//Return a etcd client.
-func newEtcdClient(endpoints []string) (*etcdcv3.Client, error) {
-	etcdCfg := etcdcv3.Config{
-		Endpoints: endpoints,
+//etcdConfig returns the configuration of the etcd client, the client connects to etcd in the background if dialTimeout is 0,
+//otherwise it fails if it can not connect to etcd within dialTimeout. The client talks to etcd over TLS if tlsConfig is set.
+func etcdConfig(endpoints []string, dialTimeout time.Duration, tlsConfig *tls.Config) etcdcv3.Config {
+	return etcdcv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+		TLS:         tlsConfig,
 	}
+}
+
+//Return a etcd client with the configuration, the client authenticates to etcd right away if the credentials are set.
+func newEtcdClient(etcdCfg etcdcv3.Config) (*etcdcv3.Client, error) {
 	cli, err := etcdcv3.New(etcdCfg)
 	if err != nil {
-		return nil, err
+		return nil, authError(err)
 	}
 	return cli, nil
 }
+
+//connect creates the etcd client of current node unless it has been created already. Creating the client fails while etcd is
+//unreachable if the credentials or the dial timeout are set, so it is done in the background with the other requests to etcd.
+func (idetcd *Idetcd) connect() error {
+	if idetcd.Client != nil {
+		return nil
+	}
+	client, err := newEtcdClient(idetcd.clientConfig)
+	if err != nil {
+		return err
+	}
+	idetcd.Client = client
+	return nil
+}
@@ -1,10 +1,25 @@
 package idetcd
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"text/template"
+	"time"
 
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coreos/etcd/embed"
 	"github.com/mholt/caddy"
 )
 
@@ -52,6 +67,270 @@ func TestParseIdetcd(t *testing.T) {
 				limit hello
 		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
 		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				limit 5
+		}`, true, []string{"http://localhost:2379"}, 5, nil, "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				fingerprint
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				fingerprint hostname
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "unknown fingerprint source",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				when_full wait
+				max_wait 30s
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				when_full retry
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				max_wait forever
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				ttl 60s
+				renew 10s 5s
+				timeout 2s
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				ttl 1500ms
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "ttl should be a whole number of seconds",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				ttl 10s
+				renew 10s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "should be below the ttl",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				ttl 10s
+				renew 8s 2s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "should be below the ttl",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				renew 5s -1s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				timeout 0s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				dial_timeout soon
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				port 2222
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				port 70000
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "invalid port",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				port grpc
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "invalid port",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				serve_stale
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				serve_stale 1m
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				serve_stale 0s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				serve_stale 1m 2m
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				answer_ttl 30s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "should not be above the ttl",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				answer_ttl 1500ms
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "whole number of seconds",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				answer_ttl -5s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				interfaces eth* ib0
+				networks 10.0.0.0/8 fd00::/8
+				exclude_networks 10.1.0.0/16
+				prefer 10.2.0.0/16
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				networks 10.0.0.1
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "invalid network",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				interfaces
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				interfaces eth[
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "invalid interface pattern",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				advertise 203.0.113.7 2001:db8::7
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				advertise 224.0.0.1
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "not a valid unicast address",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				advertise env PUBLIC_IP
+				interfaces eth0
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "can not be used with",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				startup_timeout 0s
+				address_refresh 1m
+		}`, false, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
+		{
+			`idetcd {
+				endpoint http://localhost:2379
+				pattern worker{{.ID}}.tf.local.
+				limit 5
+				startup_timeout -1s
+		}`, true, []string{"http://localhost:2379"}, 5, getExpectedPattern(), "",
+		},
 		{
 			`idetcd {
 				endpoint http://localhost:2379 http://localhost:3379 http://localhost:4379
@@ -77,8 +356,8 @@ func TestParseIdetcd(t *testing.T) {
 			}
 
 		}
-		if !test.shouldErr && idetcd.limit != test.expectedLimit {
-			t.Errorf("Idetcd not correctly set for input %s. Expected: %d, actual: %d", test.input, test.expectedLimit, idetcd.limit)
+		if !test.shouldErr && idetcd.roles[0].limit != test.expectedLimit {
+			t.Errorf("Idetcd not correctly set for input %s. Expected: %d, actual: %d", test.input, test.expectedLimit, idetcd.roles[0].limit)
 		}
 		if !test.shouldErr {
 			if len(idetcd.endpoints) != len(test.expectedEndpoint) {
@@ -93,6 +372,276 @@ func TestParseIdetcd(t *testing.T) {
 	}
 }
 
+func TestParseZones(t *testing.T) {
+	idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd tf.local example.org. {
+			pattern worker{{.ID}}.tf.local.
+			fallthrough example.org
+		}`))
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if len(idetc.zones) != 2 || idetc.zones[0] != "tf.local." || idetc.zones[1] != "example.org." {
+		t.Errorf("Expected zones tf.local. and example.org., got: %v", idetc.zones)
+	}
+	if !idetc.fall.Through("www.example.org.") || idetc.fall.Through("worker1.tf.local.") {
+		t.Errorf("Expected to fall through for example.org. only, got: %v", idetc.fall)
+	}
+}
+
+func TestParseLeaseSettings(t *testing.T) {
+	idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+			pattern worker{{.ID}}.tf.local.
+		}`))
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if idetc.ttl != defaultTTL || idetc.renew != defaultTTL/3 || idetc.jitter != 0 || idetc.timeout != defaultTimeout {
+		t.Errorf("Expected default ttl %s, renewal interval %s and timeout %s, got: %s, %s, %s", defaultTTL, defaultTTL/3,
+			defaultTimeout, idetc.ttl, idetc.renew, idetc.timeout)
+	}
+
+	idetc, err = idetcdParse(caddy.NewTestController("dns", `idetcd {
+			pattern worker{{.ID}}.tf.local.
+			ttl 60s
+			renew 10s 5s
+			timeout 2s
+		}`))
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if idetc.ttl != 60*time.Second || idetc.renew != 10*time.Second || idetc.jitter != 5*time.Second || idetc.timeout != 2*time.Second {
+		t.Errorf("Expected ttl 60s, renewal interval 10s, jitter 5s and timeout 2s, got: %s, %s, %s, %s", idetc.ttl, idetc.renew,
+			idetc.jitter, idetc.timeout)
+	}
+	if idetc.answerTTL != uint32(defaultAnswerTTL/time.Second) {
+		t.Errorf("Expected default answer ttl %s, got: %d", defaultAnswerTTL, idetc.answerTTL)
+	}
+	for i := 0; i < 100; i++ {
+		if interval := idetc.renewInterval(); interval < 10*time.Second || interval >= 15*time.Second {
+			t.Fatalf("Expected renewal interval between 10s and 15s, got: %s", interval)
+		}
+	}
+
+	if idetc.startupTimeout != defaultStartupTimeout {
+		t.Errorf("Expected default startup timeout %s, got: %s", defaultStartupTimeout, idetc.startupTimeout)
+	}
+
+	//The answer ttl is not above the ttl of the lease.
+	idetc, err = idetcdParse(caddy.NewTestController("dns", `idetcd {
+			pattern worker{{.ID}}.tf.local.
+			ttl 3s
+		}`))
+	if err != nil {
+		t.Fatalf("Expected no error but found one: %s", err)
+	}
+	if idetc.answerTTL != 3 {
+		t.Errorf("Expected the answer ttl to be capped by the ttl 3s, got: %d", idetc.answerTTL)
+	}
+	for _, answer := range []string{"0s", "30s"} {
+		idetc, err = idetcdParse(caddy.NewTestController("dns", `idetcd {
+				pattern worker{{.ID}}.tf.local.
+				ttl 30s
+				answer_ttl `+answer+`
+			}`))
+		if err != nil {
+			t.Fatalf("Expected no error for answer ttl %s but found one: %s", answer, err)
+		}
+	}
+}
+
+//testCerts generates a CA, and a server and a client certificate signed by it in dir, it returns the paths of the CA and the
+//certificates and keys of the server and the client.
+func testCerts(t *testing.T, dir string) (ca, serverCert, serverKey, clientCert, clientKey string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate the key: %s", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "idetcd test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Could not create the ca: %s", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	ca = filepath.Join(dir, "ca.pem")
+	writePEM(t, ca, "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("Could not generate the key: %s", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Could not create the certificate of %s: %s", name, err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Could not marshal the key of %s: %s", name, err)
+		}
+		cert, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, cert, "CERTIFICATE", der)
+		writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+		return cert, keyPath
+	}
+	serverCert, serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write %s: %s", path, err)
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idetcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ca, _, _, cert, key := testCerts(t, dir)
+
+	tests := []struct {
+		endpoint           string
+		args               string
+		shouldErr          bool
+		expectedErrContent string
+	}{
+		{"https://localhost:2379", cert + " " + key + " " + ca, false, ""},
+		{"https://localhost:2379", ca, false, ""},
+		{"http://localhost:2379", cert + " " + key + " " + ca, true, "https endpoints"},
+		{"https://localhost:2379", cert + " " + key + " " + filepath.Join(dir, "missing.pem"), true, ""},
+		{"https://localhost:2379", key + " " + cert + " " + ca, true, "could not load TLS cert"},
+		{"https://localhost:2379", cert + " " + key + " " + ca + " " + ca, true, "maximum of three arguments"},
+	}
+	for i, tc := range tests {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+				endpoint `+tc.endpoint+`
+				pattern worker{{.ID}}.tf.local.
+				tls `+tc.args+`
+			}`))
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error but found none", i)
+			} else if !strings.Contains(err.Error(), tc.expectedErrContent) {
+				t.Errorf("Test %d: Expected error to contain %q, got: %s", i, tc.expectedErrContent, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found one: %s", i, err)
+			continue
+		}
+		if idetc.clientConfig.TLS == nil {
+			t.Errorf("Test %d: Expected the etcd client to use TLS", i)
+		}
+	}
+}
+
+//startEtcd starts an embedded etcd which only listens on localhost, so the test runs against a fresh etcd of its own. configure
+//adjusts the configuration before it starts, and the returned function stops it.
+func startEtcd(t *testing.T, configure func(cfg *embed.Config)) (string, func()) {
+	dir, err := ioutil.TempDir("", "idetcd-etcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LPUrls = []url.URL{{Scheme: "http", Host: "127.0.0.1:0"}}
+	cfg.APUrls = cfg.LPUrls
+	cfg.LCUrls = []url.URL{{Scheme: "http", Host: "127.0.0.1:0"}}
+	cfg.ACUrls = cfg.LCUrls
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	if configure != nil {
+		configure(cfg)
+	}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not start etcd: %s", err)
+	}
+	stop := func() {
+		e.Close()
+		os.RemoveAll(dir)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		stop()
+		t.Fatalf("etcd is not ready")
+	}
+	return cfg.LCUrls[0].Scheme + "://" + e.Clients[0].Addr().String(), stop
+}
+
+//TestEtcdTLS claims a slot from an etcd which requires client certificates.
+func TestEtcdTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idetcd")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ca, serverCert, serverKey, cert, key := testCerts(t, dir)
+	endpoint, stop := startEtcd(t, func(cfg *embed.Config) {
+		cfg.LCUrls = []url.URL{{Scheme: "https", Host: "127.0.0.1:0"}}
+		cfg.ACUrls = cfg.LCUrls
+		cfg.ClientTLSInfo.CertFile = serverCert
+		cfg.ClientTLSInfo.KeyFile = serverKey
+		cfg.ClientTLSInfo.TrustedCAFile = ca
+		cfg.ClientTLSInfo.ClientCertAuth = true
+	})
+	defer stop()
+
+	parse := func(args string) *Idetcd {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", `idetcd {
+				endpoint `+endpoint+`
+				pattern worker{{.ID}}.tf.local.
+				timeout 2s
+				tls `+args+`
+			}`))
+		if err != nil {
+			t.Fatalf("Could not parse the tls settings %s: %s", args, err)
+		}
+		return idetc
+	}
+	idetc := parse(cert + " " + key + " " + ca)
+	if err := idetc.connect(); err != nil {
+		t.Fatalf("Could not connect to etcd: %s", err)
+	}
+	defer idetc.Client.Close()
+	if name, err := idetc.claimSlot("value", 0); err != nil || name != "worker1.tf.local." {
+		t.Errorf("Expected to claim worker1.tf.local. over https, got: %s, %v", name, err)
+	}
+
+	//The etcd requires a client certificate.
+	anonymous := parse(ca)
+	if err := anonymous.connect(); err != nil {
+		t.Fatalf("Could not connect to etcd: %s", err)
+	}
+	defer anonymous.Client.Close()
+	if _, err := anonymous.claimSlot("value", 0); err == nil {
+		t.Errorf("Expected the claim without a client certificate to fail")
+	}
+}
+
 func getExpectedPattern() *template.Template {
 	pattern := template.New("idetcd")
 	pattern, err := pattern.Parse("worker{{.ID}}.tf.local.")
@@ -113,4 +662,10 @@ func TestSetup(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Shouldn't fail")
 	}
+	//Release the slot like a graceful shutdown does, so the node does not hold it for the rest of the tests.
+	idetc := dnsserver.GetConfig(c).Plugin[0](nil).(*Idetcd)
+	if err := idetc.shutdown(); err != nil {
+		t.Errorf("Could not shut down: %s", err)
+	}
+	deleteAll()
 }
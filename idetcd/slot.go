@@ -0,0 +1,118 @@
+package idetcd
+
+import (
+	"strconv"
+	"strings"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+)
+
+//claimSlot tries to take the free slot with the smallest id for current node, the record is put with value and attached to the lease.
+//The roles which current node can take are tried in priority order, and if current node has a fingerprint, the slot it held
+//before restart is tried first.
+//It returns the domain name of the slot, or an empty string if all the slots until the limits are already taken by other nodes.
+func (idetcd *Idetcd) claimSlot(value string, lease etcdcv3.LeaseID) (string, error) {
+	previous := make(map[*role]int)
+	for _, r := range idetcd.candidates() {
+		id, err := idetcd.previousID(r)
+		if err != nil {
+			return "", err
+		}
+		if id == 0 || id > r.currentLimit() {
+			continue
+		}
+		previous[r] = id
+		name, err := idetcd.claimID(r, id, value, lease)
+		if err != nil || name != "" {
+			return name, err
+		}
+		log.Infof("Slot %d of role %s held by %s before is taken by another node", id, r.name, idetcd.fingerprint)
+	}
+	for _, r := range idetcd.candidates() {
+		free, err := idetcd.freeIDs(r)
+		if err != nil {
+			return "", err
+		}
+		//Other nodes may take some of the free slots before current node does, so just move on to the next one in that case.
+		for _, id := range free {
+			if id == previous[r] {
+				continue
+			}
+			name, err := idetcd.claimID(r, id, value, lease)
+			if err != nil || name != "" {
+				return name, err
+			}
+		}
+	}
+	idetcd.mu.Lock()
+	idetcd.ID = 0
+	idetcd.mu.Unlock()
+	return "", nil
+}
+
+//claimID tries to take the slot of the role with the given id, it returns the domain name of the slot if it succeeds, or an empty
+//string if the slot is already taken by other node.
+func (idetcd *Idetcd) claimID(r *role, id int, value string, lease etcdcv3.LeaseID) (string, error) {
+	name, err := r.domainName(id)
+	if err != nil {
+		return "", err
+	}
+	//Remember the id for the fingerprint of current node in the same transaction, so the slot is never taken without it. It is not
+	//attached to any lease so it survives restarts.
+	var also []etcdcv3.Op
+	if idetcd.fingerprint != "" {
+		also = append(also, etcdcv3.OpPut(r.fingerprintKey(idetcd.fingerprint), strconv.Itoa(id)))
+	}
+	//The proposed domain name is only taken if no other node has created it in the etcd, even if they try at the same time.
+	ok, err := idetcd.claim(r.slotKey(id), value, lease, also...)
+	if err != nil || !ok {
+		return "", err
+	}
+	idetcd.mu.Lock()
+	idetcd.ID = id
+	idetcd.role = r
+	idetcd.mu.Unlock()
+	return name, nil
+}
+
+//freeIDs returns the ids of the slots of the role which are not taken by any node yet in ascending order, all the slots are
+//read with a single range request on their common prefix.
+func (idetcd *Idetcd) freeIDs(r *role) ([]int, error) {
+	resp, err := idetcd.get(r.slotPrefix(), etcdcv3.WithPrefix(), etcdcv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[int]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		id, err := strconv.Atoi(strings.TrimPrefix(string(kv.Key), r.slotPrefix()))
+		if err == nil {
+			taken[id] = true
+		}
+	}
+	var free []int
+	for id, limit := 1, r.currentLimit(); id <= limit; id++ {
+		if !taken[id] {
+			free = append(free, id)
+		}
+	}
+	return free, nil
+}
+
+//previousID returns the id of the role held by the fingerprint of current node before, or 0 if there is none.
+func (idetcd *Idetcd) previousID(r *role) (int, error) {
+	if idetcd.fingerprint == "" {
+		return 0, nil
+	}
+	resp, err := idetcd.get(r.fingerprintKey(idetcd.fingerprint))
+	if err != nil {
+		return 0, err
+	}
+	if resp.Count == 0 {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(string(resp.Kvs[0].Value))
+	if err != nil {
+		return 0, nil
+	}
+	return id, nil
+}
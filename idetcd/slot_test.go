@@ -0,0 +1,68 @@
+package idetcd
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+//benchmarkSlots fills the first half of the slots in etcd, and returns an Idetcd whose limit is numSlot.
+func benchmarkSlots(b *testing.B, numSlot int) *Idetcd {
+	c := caddy.NewTestController("dns", `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit `+strconv.Itoa(numSlot)+`
+		}`)
+	idetc, err := idetcdParse(c)
+	if err != nil {
+		b.Fatalf("Could not parse the corefile: %s", err)
+	}
+	if err := idetc.connect(); err != nil {
+		b.Fatalf("Could not connect to etcd: %s", err)
+	}
+	for id := 1; id <= numSlot/2; id++ {
+		if _, err := idetc.set(idetc.roles[0].slotKey(id), "value"); err != nil {
+			b.Fatalf("Could not fill the slot %d: %s", id, err)
+		}
+	}
+	b.ResetTimer()
+	return idetc
+}
+
+//BenchmarkFreeIDsRange finds the first free slot with a single range read on the prefix of the slots.
+func BenchmarkFreeIDsRange(b *testing.B) {
+	idetc := benchmarkSlots(b, 2000)
+	defer idetc.Client.Close()
+	for i := 0; i < b.N; i++ {
+		free, err := idetc.freeIDs(idetc.roles[0])
+		if err != nil || len(free) == 0 {
+			b.Fatalf("Could not find any free slot: %v", err)
+		}
+	}
+	b.StopTimer()
+	deleteAll()
+}
+
+//BenchmarkFreeIDsProbe finds the first free slot by probing the slots one by one, which is what idetcd used to do.
+func BenchmarkFreeIDsProbe(b *testing.B) {
+	idetc := benchmarkSlots(b, 2000)
+	defer idetc.Client.Close()
+	for i := 0; i < b.N; i++ {
+		id := 1
+		for ; id <= idetc.roles[0].limit; id++ {
+			resp, err := idetc.get(idetc.roles[0].slotKey(id))
+			if err != nil {
+				b.Fatalf("Could not get the slot %d: %s", id, err)
+			}
+			if resp.Count == 0 {
+				break
+			}
+		}
+		if id > idetc.roles[0].limit {
+			b.Fatalf("Could not find any free slot")
+		}
+	}
+	b.StopTimer()
+	deleteAll()
+}
@@ -0,0 +1,117 @@
+package idetcd
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+)
+
+//store is where ServeDNS reads the records of the slots from.
+type store interface {
+	//record returns the record saved in the key, or nil if the key does not exist.
+	record(key string) (*Record, error)
+	//records returns all the records saved under the prefix by their keys.
+	records(prefix string) (map[string]*Record, error)
+	//keysOf returns the keys of all the records which have the address.
+	keysOf(addr string) ([]string, error)
+	//loaded returns whether the records of all the roles have been read, nothing is known about the slots before that.
+	loaded() bool
+	//staleness returns how long the records may have been stale, it is 0 if they are current.
+	staleness() time.Duration
+	//remaining returns how long the record saved in the key lives at least, as bounded by the lease it is attached to, it returns
+	//false if the record is not attached to a lease.
+	remaining(key string) (time.Duration, bool)
+	//revision returns the etcd revision of the last change of the records saved under the prefix which has been seen, it never
+	//decreases.
+	revision(prefix string) (int64, error)
+}
+
+//etcdStore reads the records from the etcd on every query.
+type etcdStore struct {
+	idetcd *Idetcd
+}
+
+func (s etcdStore) record(key string) (*Record, error) {
+	resp, err := s.idetcd.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	record := new(Record)
+	if err := json.Unmarshal(resp.Kvs[0].Value, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//keysOf reads all the records of the slots of every role to find the ones with the address.
+func (s etcdStore) keysOf(addr string) ([]string, error) {
+	var keys []string
+	for _, r := range s.idetcd.roles {
+		records, err := s.records(r.slotPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for key, record := range records {
+			for _, a := range record.addresses() {
+				if a == addr {
+					keys = append(keys, key)
+					break
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+//loaded is always true, as the records are read from the etcd on every query.
+func (s etcdStore) loaded() bool { return true }
+
+//staleness is always 0, as the records are read from the etcd directly.
+func (s etcdStore) staleness() time.Duration { return 0 }
+
+//remaining reads the lease which the record is attached to and its remaining time from the etcd.
+func (s etcdStore) remaining(key string) (time.Duration, bool) {
+	resp, err := s.idetcd.get(key, etcdcv3.WithKeysOnly())
+	if err != nil || resp.Count == 0 || resp.Kvs[0].Lease == 0 {
+		return 0, false
+	}
+	ctx, cancel := context.WithTimeout(s.idetcd.Ctx, s.idetcd.timeout)
+	defer cancel()
+	ttl, err := s.idetcd.Client.TimeToLive(ctx, etcdcv3.LeaseID(resp.Kvs[0].Lease))
+	if err != nil {
+		return 0, true
+	}
+	return time.Duration(ttl.TTL) * time.Second, true
+}
+
+//revision returns the current revision of the etcd, the deletes under the prefix can not be read back, so any later revision is
+//taken instead.
+func (s etcdStore) revision(prefix string) (int64, error) {
+	resp, err := s.idetcd.get(prefix, etcdcv3.WithPrefix(), etcdcv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func (s etcdStore) records(prefix string) (map[string]*Record, error) {
+	resp, err := s.idetcd.get(prefix, etcdcv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*Record, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		record := new(Record)
+		if err := json.Unmarshal(kv.Value, record); err != nil {
+			log.Warningf("Invalid record in %s: %s", kv.Key, err)
+			continue
+		}
+		records[string(kv.Key)] = record
+	}
+	return records, nil
+}
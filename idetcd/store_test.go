@@ -0,0 +1,518 @@
+package idetcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+//fakeStore is a store which keeps the records in memory, or fails every read if err is set.
+type fakeStore struct {
+	data  map[string]*Record
+	err   error
+	stale time.Duration
+	rev   int64
+	//loading is set while the records have not been read yet.
+	loading bool
+	//remain keeps the remaining time of the leases of the records.
+	remain map[string]time.Duration
+}
+
+func (s fakeStore) keysOf(addr string) ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	var keys []string
+	for key, record := range s.data {
+		for _, a := range record.addresses() {
+			if a == addr {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s fakeStore) loaded() bool { return !s.loading }
+
+func (s fakeStore) staleness() time.Duration { return s.stale }
+
+func (s fakeStore) revision(prefix string) (int64, error) { return s.rev, s.err }
+
+func (s fakeStore) remaining(key string) (time.Duration, bool) {
+	remaining, ok := s.remain[key]
+	return remaining, ok
+}
+
+func (s fakeStore) record(key string) (*Record, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.data[key], nil
+}
+
+func (s fakeStore) records(prefix string) (map[string]*Record, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	records := make(map[string]*Record)
+	for key, record := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			records[key] = record
+		}
+	}
+	return records, nil
+}
+
+//newFakeIdetcd returns an idetcd with a single role worker{{.ID}}.tf.local. which serves the records from the store.
+func newFakeIdetcd(t *testing.T, s store) *Idetcd {
+	r, err := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	if err != nil {
+		t.Fatalf("Could not create the role: %s", err)
+	}
+	return &Idetcd{Next: test.NextHandler(dns.RcodeRefused, nil), roles: []*role{r}, store: s}
+}
+
+func TestServeDNS(t *testing.T) {
+	r, _ := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	s := fakeStore{data: map[string]*Record{
+		r.slotKey(1): {Ipv4: "10.0.0.1", Ipv6: "fd00::1", Port: "2222"},
+		r.slotKey(2): {Ipv4: "10.0.0.2"},
+		r.slotKey(3): {Ipv6: "fd00::3", Port: "2224"},
+	}}
+	soa := test.SOA("tf.local. 0 IN SOA worker1.tf.local. hostmaster.dns.tf.local. 0 7200 1800 86400 0")
+	tests := []test.Case{
+		{
+			Qname: "worker1.tf.local.", Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("worker1.tf.local. 0 IN A 10.0.0.1")},
+		},
+		{
+			Qname: "WORKER1.tf.local.", Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("WORKER1.tf.local. 0 IN A 10.0.0.1")},
+		},
+		{
+			Qname: "worker1.tf.local.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{test.AAAA("worker1.tf.local. 0 IN AAAA fd00::1")},
+		},
+		//NODATA for the address family the node does not have.
+		{
+			Qname: "worker2.tf.local.", Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{soa},
+		},
+		{
+			Qname: "worker3.tf.local.", Qtype: dns.TypeA,
+			Ns: []dns.RR{soa},
+		},
+		{
+			Qname: "worker1.tf.local.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{soa},
+		},
+		{
+			Qname: "tf.local.", Qtype: dns.TypeA,
+			Ns: []dns.RR{soa},
+		},
+		//The zone has an SOA record, and every member is a name server of the zone.
+		{
+			Qname: "tf.local.", Qtype: dns.TypeSOA,
+			Answer: []dns.RR{soa},
+		},
+		{
+			Qname: "tf.local.", Qtype: dns.TypeNS,
+			Answer: []dns.RR{
+				test.NS("tf.local. 0 IN NS worker1.tf.local."),
+				test.NS("tf.local. 0 IN NS worker2.tf.local."),
+				test.NS("tf.local. 0 IN NS worker3.tf.local."),
+			},
+			Extra: []dns.RR{
+				test.A("worker1.tf.local. 0 IN A 10.0.0.1"),
+				test.AAAA("worker1.tf.local. 0 IN AAAA fd00::1"),
+				test.A("worker2.tf.local. 0 IN A 10.0.0.2"),
+				test.AAAA("worker3.tf.local. 0 IN AAAA fd00::3"),
+			},
+		},
+		//SRV records of the service names with the addresses as glue.
+		{
+			Qname: "_grpc._tcp.worker1.tf.local.", Qtype: dns.TypeSRV,
+			Answer: []dns.RR{test.SRV("_grpc._tcp.worker1.tf.local. 0 IN SRV 0 0 2222 worker1.tf.local.")},
+			Extra: []dns.RR{
+				test.A("worker1.tf.local. 0 IN A 10.0.0.1"),
+				test.AAAA("worker1.tf.local. 0 IN AAAA fd00::1"),
+			},
+		},
+		{
+			Qname: "_grpc._tcp.worker1.tf.local.", Qtype: dns.TypeA,
+			Ns: []dns.RR{soa},
+		},
+		{
+			Qname: "worker1.tf.local.", Qtype: dns.TypeSRV,
+			Ns: []dns.RR{soa},
+		},
+		//No SRV record if the node does not advertise a port.
+		{
+			Qname: "_grpc._tcp.worker2.tf.local.", Qtype: dns.TypeSRV,
+			Ns: []dns.RR{soa},
+		},
+		{
+			Qname: "_grpc._tcp.worker4.tf.local.", Qtype: dns.TypeSRV,
+			Rcode: dns.RcodeNameError,
+			Ns:    []dns.RR{soa},
+		},
+		//The enumeration name covers all the claimed slots.
+		{
+			Qname: "_members.tf.local.", Qtype: dns.TypeSRV,
+			Answer: []dns.RR{
+				test.SRV("_members.tf.local. 0 IN SRV 0 0 2222 worker1.tf.local."),
+				test.SRV("_members.tf.local. 0 IN SRV 0 0 2224 worker3.tf.local."),
+			},
+			Extra: []dns.RR{
+				test.A("worker1.tf.local. 0 IN A 10.0.0.1"),
+				test.AAAA("worker1.tf.local. 0 IN AAAA fd00::1"),
+				test.AAAA("worker3.tf.local. 0 IN AAAA fd00::3"),
+			},
+		},
+		{
+			Qname: "_members.tf.local.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("_members.tf.local. 0 IN A 10.0.0.1"),
+				test.A("_members.tf.local. 0 IN A 10.0.0.2"),
+			},
+		},
+		{
+			Qname: "_members.tf.local.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("_members.tf.local. 0 IN AAAA fd00::1"),
+				test.AAAA("_members.tf.local. 0 IN AAAA fd00::3"),
+			},
+		},
+		{
+			Qname: "_members.tf.local.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{soa},
+		},
+		//NXDOMAIN for the slots which are not taken and the other names in the zone.
+		{
+			Qname: "worker4.tf.local.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns:    []dns.RR{soa},
+		},
+		{
+			Qname: "worker9.tf.local.", Qtype: dns.TypeAAAA,
+			Rcode: dns.RcodeNameError,
+			Ns:    []dns.RR{soa},
+		},
+		{
+			Qname: "ps1.tf.local.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns:    []dns.RR{soa},
+		},
+	}
+	idetc := newFakeIdetcd(t, s)
+	for i, tc := range tests {
+		rec := dnstest.NewMultiRecorder(&test.ResponseWriter{})
+		rcode, err := idetc.ServeDNS(context.Background(), rec, tc.Msg())
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %s", i, err)
+			continue
+		}
+		if rcode != dns.RcodeSuccess {
+			t.Errorf("Test %d: Expected the response to be written by idetcd, got rcode %d", i, rcode)
+		}
+		if len(rec.Msgs) != 1 {
+			t.Errorf("Test %d: Expected a single reply, got %d", i, len(rec.Msgs))
+			continue
+		}
+		if !rec.Msgs[0].Authoritative {
+			t.Errorf("Test %d: Expected an authoritative reply", i)
+		}
+		test.SortAndCheck(t, rec.Msgs[0], tc)
+	}
+}
+
+func TestServeDNSStoreError(t *testing.T) {
+	idetc := newFakeIdetcd(t, fakeStore{err: errors.New("etcd is down")})
+	rec := dnstest.NewMultiRecorder(&test.ResponseWriter{})
+	m := new(dns.Msg)
+	m.SetQuestion("worker1.tf.local.", dns.TypeA)
+	rcode, err := idetc.ServeDNS(context.Background(), rec, m)
+	if rcode != dns.RcodeServerFailure || err == nil {
+		t.Errorf("Expected SERVFAIL with an error, got rcode %d and error %v", rcode, err)
+	}
+	//The server writes the SERVFAIL reply for idetcd.
+	if len(rec.Msgs) != 0 {
+		t.Errorf("Expected no reply written by idetcd, got %d", len(rec.Msgs))
+	}
+}
+
+func TestServeDNSReverse(t *testing.T) {
+	r, _ := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	s := fakeStore{data: map[string]*Record{
+		r.slotKey(1): {Ipv4: "10.0.0.1", Ipv6: "fd00::1"},
+		r.slotKey(2): {Ipv4: "10.0.0.2"},
+		//Two instances on the same host.
+		r.slotKey(3): {Ipv4: "10.0.0.2"},
+	}}
+	tests := []test.Case{
+		{
+			Qname: "1.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR,
+			Answer: []dns.RR{test.PTR("1.0.0.10.in-addr.arpa. 0 IN PTR worker1.tf.local.")},
+		},
+		{
+			Qname: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", Qtype: dns.TypePTR,
+			Answer: []dns.RR{test.PTR("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. 0 IN PTR worker1.tf.local.")},
+		},
+		{
+			Qname: "2.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR,
+			Answer: []dns.RR{
+				test.PTR("2.0.0.10.in-addr.arpa. 0 IN PTR worker2.tf.local."),
+				test.PTR("2.0.0.10.in-addr.arpa. 0 IN PTR worker3.tf.local."),
+			},
+		},
+	}
+	idetc := newFakeIdetcd(t, s)
+	for i, tc := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := idetc.ServeDNS(context.Background(), rec, tc.Msg()); err != nil {
+			t.Errorf("Test %d: Expected no error, got: %s", i, err)
+			continue
+		}
+		test.SortAndCheck(t, rec.Msg, tc)
+	}
+
+	//The addresses out of the cluster are passed to the next plugin.
+	m := new(dns.Msg)
+	m.SetQuestion("9.0.0.10.in-addr.arpa.", dns.TypePTR)
+	if rcode, _ := idetc.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), m); rcode != dns.RcodeRefused {
+		t.Errorf("Expected the query to be passed to the next plugin, got rcode %d", rcode)
+	}
+}
+
+func TestSOASerial(t *testing.T) {
+	idetc := newFakeIdetcd(t, fakeStore{rev: 42})
+	m := new(dns.Msg)
+	m.SetQuestion("tf.local.", dns.TypeSOA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	idetc.ServeDNS(context.Background(), rec, m)
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("Expected the SOA record of the zone, got: %v", rec.Msg)
+	}
+	soa := rec.Msg.Answer[0].(*dns.SOA)
+	if soa.Serial != 42 {
+		t.Errorf("Expected the serial to be the revision 42, got: %d", soa.Serial)
+	}
+	//The zone has no member to be its primary name server.
+	if soa.Ns != "tf.local." {
+		t.Errorf("Expected the zone to be its own primary name server, got: %s", soa.Ns)
+	}
+}
+
+func TestServeDNSAddresses(t *testing.T) {
+	r, _ := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	s := fakeStore{data: map[string]*Record{
+		r.slotKey(1): {
+			Ipv4: "10.0.0.1", Ipv4s: []string{"10.0.0.1", "192.168.0.1"},
+			Ipv6: "fd00::1", Ipv6s: []string{"fd00::1", "fd01::1"},
+		},
+		//Two instances on the same host.
+		r.slotKey(2): {Ipv4: "192.168.0.1"},
+	}}
+	idetc := newFakeIdetcd(t, s)
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		answer []string
+	}{
+		//All the addresses of the node are answered in the order of preference.
+		{"worker1.tf.local.", dns.TypeA, []string{"10.0.0.1", "192.168.0.1"}},
+		{"worker1.tf.local.", dns.TypeAAAA, []string{"fd00::1", "fd01::1"}},
+		//The address shared by both members is answered once.
+		{"_members.tf.local.", dns.TypeA, []string{"10.0.0.1", "192.168.0.1"}},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		idetc.ServeDNS(context.Background(), rec, m)
+		if rec.Msg == nil || len(rec.Msg.Answer) != len(tc.answer) {
+			t.Fatalf("Expected %d addresses for %s, got: %v", len(tc.answer), tc.qname, rec.Msg)
+		}
+		for i, rr := range rec.Msg.Answer {
+			var ip string
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A.String()
+			case *dns.AAAA:
+				ip = rr.AAAA.String()
+			}
+			if ip != tc.answer[i] {
+				t.Errorf("Expected address %s at %d for %s, got: %s", tc.answer[i], i, tc.qname, rr)
+			}
+		}
+	}
+}
+
+func TestServeDNSAnswerTTL(t *testing.T) {
+	r, _ := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	s := fakeStore{
+		data: map[string]*Record{
+			r.slotKey(1): {Ipv4: "10.0.0.1"},
+			r.slotKey(2): {Ipv4: "10.0.0.2"},
+			r.slotKey(3): {Ipv4: "10.0.0.3"},
+		},
+		remain: map[string]time.Duration{
+			r.slotKey(1): 2500 * time.Millisecond,
+			r.slotKey(3): -time.Second,
+		},
+	}
+	idetc := newFakeIdetcd(t, s)
+	idetc.answerTTL = 5
+	tests := []struct {
+		qname string
+		ttl   uint32
+	}{
+		//The answers are not cached for longer than the lease of the record may live.
+		{"worker1.tf.local.", 2},
+		//The answer ttl is used if the lease of the record is not known.
+		{"worker2.tf.local.", 5},
+		//The lease of the record has expired already.
+		{"worker3.tf.local.", 0},
+		//The enumeration is capped by the lease which expires first.
+		{"_members.tf.local.", 0},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		idetc.ServeDNS(context.Background(), rec, m)
+		if rec.Msg == nil || len(rec.Msg.Answer) == 0 {
+			t.Fatalf("Expected the answer of %s, got: %v", tc.qname, rec.Msg)
+		}
+		for _, rr := range rec.Msg.Answer {
+			if rr.Header().Ttl != tc.ttl {
+				t.Errorf("Expected ttl %d for %s, got: %s", tc.ttl, tc.qname, rr)
+			}
+		}
+	}
+
+	//Negative answers are cached for the minimum of the SOA record, which is the answer ttl.
+	m := new(dns.Msg)
+	m.SetQuestion("worker4.tf.local.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	idetc.ServeDNS(context.Background(), rec, m)
+	if rec.Msg == nil || len(rec.Msg.Ns) != 1 {
+		t.Fatalf("Expected the SOA record in the authority section, got: %v", rec.Msg)
+	}
+	if soa := rec.Msg.Ns[0].(*dns.SOA); soa.Hdr.Ttl != 5 || soa.Minttl != 5 {
+		t.Errorf("Expected the SOA record with ttl and minimum 5, got: %s", soa)
+	}
+}
+
+func TestServeDNSStale(t *testing.T) {
+	r, _ := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	data := map[string]*Record{r.slotKey(1): {Ipv4: "10.0.0.1"}}
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		loading  bool
+		stale    time.Duration
+		maxStale time.Duration
+		rcode    int
+	}{
+		{"worker1.tf.local.", dns.TypeA, false, 0, 0, dns.RcodeSuccess},
+		{"worker1.tf.local.", dns.TypeA, false, time.Second, 0, dns.RcodeServerFailure},
+		{"worker1.tf.local.", dns.TypeA, false, time.Minute, 10 * time.Minute, dns.RcodeSuccess},
+		{"worker1.tf.local.", dns.TypeA, false, time.Hour, 10 * time.Minute, dns.RcodeServerFailure},
+		//Nothing is answered before the records have been read, even with serve_stale.
+		{"worker1.tf.local.", dns.TypeA, true, 0, 10 * time.Minute, dns.RcodeServerFailure},
+		//Reverse lookups are left to the next plugin while the members are unknown.
+		{"8.8.8.8.in-addr.arpa.", dns.TypePTR, true, 0, 0, dns.RcodeRefused},
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, false, time.Second, 0, dns.RcodeRefused},
+	}
+	for i, tc := range tests {
+		idetc := newFakeIdetcd(t, fakeStore{data: data, stale: tc.stale, loading: tc.loading})
+		idetc.maxStale = tc.maxStale
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, err := idetc.ServeDNS(context.Background(), rec, m)
+		if rcode != tc.rcode {
+			t.Errorf("Test %d: Expected rcode %d, got %d (%v)", i, tc.rcode, rcode, err)
+		}
+	}
+}
+
+func TestCapTTL(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{test.A("worker1.tf.local. 30 IN A 10.0.0.1"), test.A("worker2.tf.local. 2 IN A 10.0.0.2")}
+	m.Ns = []dns.RR{test.SOA("tf.local. 60 IN SOA ns.dns.tf.local. hostmaster.dns.tf.local. 0 7200 1800 86400 0")}
+	capTTL(m, staleTTL)
+	for _, rr := range append(m.Answer, m.Ns...) {
+		if rr.Header().Ttl > staleTTL {
+			t.Errorf("Expected the ttl to be capped at %d, got: %s", staleTTL, rr)
+		}
+	}
+	if m.Answer[1].Header().Ttl != 2 {
+		t.Errorf("Expected a lower ttl to be kept, got: %s", m.Answer[1])
+	}
+}
+
+func TestServeDNSNoMembers(t *testing.T) {
+	idetc := newFakeIdetcd(t, fakeStore{})
+	rec := dnstest.NewMultiRecorder(&test.ResponseWriter{})
+	m := new(dns.Msg)
+	m.SetQuestion("_members.tf.local.", dns.TypeSRV)
+	idetc.ServeDNS(context.Background(), rec, m)
+	if len(rec.Msgs) != 1 || rec.Msgs[0].Rcode != dns.RcodeSuccess || len(rec.Msgs[0].Answer) != 0 {
+		t.Fatalf("Expected an empty answer for a cluster without members, got: %v", rec.Msgs)
+	}
+}
+
+func TestServeDNSFallthrough(t *testing.T) {
+	r, _ := newRole(defaultRole, "worker{{.ID}}.tf.local.", 5)
+	data := map[string]*Record{r.slotKey(1): {Ipv4: "10.0.0.1"}}
+	tests := []struct {
+		zones    []string
+		fall     []string
+		qname    string
+		expected int
+	}{
+		//The names in the zone which are not taken are passed to the next plugin only with fallthrough.
+		{nil, nil, "worker2.tf.local.", dns.RcodeSuccess},
+		{nil, []string{}, "worker2.tf.local.", dns.RcodeRefused},
+		{nil, []string{}, "worker1.tf.local.", dns.RcodeSuccess},
+		{nil, []string{"tf.local."}, "ps1.tf.local.", dns.RcodeRefused},
+		{nil, []string{"example.org."}, "ps1.tf.local.", dns.RcodeSuccess},
+		//Only the names in the zones of the Corefile are answered.
+		{[]string{"local."}, nil, "tf.local.", dns.RcodeSuccess},
+		{[]string{"example.org."}, nil, "worker1.tf.local.", dns.RcodeRefused},
+		{[]string{"example.org."}, nil, "www.example.org.", dns.RcodeSuccess},
+	}
+	for i, tc := range tests {
+		idetc := newFakeIdetcd(t, fakeStore{data: data})
+		idetc.zones = tc.zones
+		if tc.fall != nil {
+			idetc.fall.SetZonesFromArgs(tc.fall)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		rcode, _ := idetc.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+		if rcode != tc.expected {
+			t.Errorf("Test %d: Expected rcode %d for %s, got %d", i, tc.expected, tc.qname, rcode)
+		}
+	}
+}
+
+func TestServeDNSOutOfZone(t *testing.T) {
+	idetc := newFakeIdetcd(t, fakeStore{})
+	rec := dnstest.NewMultiRecorder(&test.ResponseWriter{})
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rcode, _ := idetc.ServeDNS(context.Background(), rec, m)
+	if rcode != dns.RcodeRefused || len(rec.Msgs) != 0 {
+		t.Errorf("Expected the query to be passed to the next plugin, got rcode %d and %d replies", rcode, len(rec.Msgs))
+	}
+}
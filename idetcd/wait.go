@@ -0,0 +1,159 @@
+package idetcd
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	etcdcv3 "github.com/coreos/etcd/clientv3"
+)
+
+const (
+	whenFullFail = "fail"
+	whenFullWait = "wait"
+)
+
+//waitSlot parks current node as a standby until it can take a free slot, and returns the domain name of the slot. Nodes which
+//are waiting at the same time are queued by the create revision of their keys under the waiters prefix of every role they can
+//take, and only the first ones in the queue try to take the free slots, so standbys are promoted in the order they arrive.
+//It returns an empty string if ctx is done or the node has waited for longer than the maximum wait.
+func (idetcd *Idetcd) waitSlot(ctx context.Context, value string) string {
+	if idetcd.maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, idetcd.maxWait)
+		defer cancel()
+	}
+	stopLease := func() {}
+	defer func() { stopLease() }()
+	defer idetcd.leave()
+
+	for {
+		revs := make(map[*role]int64)
+		queued := true
+		for _, r := range idetcd.candidates() {
+			name, rev, err := idetcd.nextInLine(r, value)
+			if err != nil {
+				log.Errorf("Could not take a free slot of role %s while waiting: %s", r.name, err)
+			}
+			if name != "" {
+				return name
+			}
+			if rev == 0 {
+				queued = false
+			}
+			revs[r] = rev
+		}
+		if !queued {
+			//The waiter keys of current node are gone, e.g. the lease has expired while etcd was unreachable, so join the queues again.
+			if err := idetcd.register(); err != nil {
+				log.Errorf("Could not join the queue of waiting nodes: %s", err)
+			} else {
+				stopLease()
+				stopLease = idetcd.keepLease(ctx)
+				continue
+			}
+		}
+		if !idetcd.waitChange(ctx, revs) {
+			log.Errorf("Stop waiting for a free slot: %s", ctx.Err())
+			return ""
+		}
+	}
+}
+
+//waitChange blocks until something changes in the slots, the queues or the cluster-wide configurations of the roles after the
+//given revisions. It returns false if ctx is done.
+func (idetcd *Idetcd) waitChange(ctx context.Context, revs map[*role]int64) bool {
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	changed := make(chan struct{}, 1)
+	notify := func(ch etcdcv3.WatchChan) {
+		<-ch
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	for r, rev := range revs {
+		var opts []etcdcv3.OpOption
+		if rev > 0 {
+			opts = append(opts, etcdcv3.WithRev(rev+1))
+		}
+		go notify(idetcd.Client.Watch(watchCtx, r.currentPattern().prefix, append(opts, etcdcv3.WithPrefix())...))
+		go notify(idetcd.Client.Watch(watchCtx, r.configKey, opts...))
+	}
+	select {
+	case <-changed:
+	case <-time.After(idetcd.renewInterval()):
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+//nextInLine tries to take a free slot of the role if current node is at the front of its queue. It returns the domain name of
+//the slot if it succeeds, and the revision of the queue which is 0 if current node is not in the queue.
+func (idetcd *Idetcd) nextInLine(r *role, value string) (string, int64, error) {
+	resp, err := idetcd.get(r.waiterPrefix(), etcdcv3.WithPrefix(), etcdcv3.WithKeysOnly(),
+		etcdcv3.WithSort(etcdcv3.SortByCreateRevision, etcdcv3.SortAscend))
+	if err != nil {
+		return "", -1, err
+	}
+	position := -1
+	for i, kv := range resp.Kvs {
+		if string(kv.Key) == idetcd.waiterKey(r) {
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		return "", 0, nil
+	}
+	free, err := idetcd.freeIDs(r)
+	if err != nil {
+		return "", resp.Header.Revision, err
+	}
+	//Only the nodes which arrived earlier than the others take the free slots, one free slot for each of them.
+	if position >= len(free) {
+		return "", resp.Header.Revision, nil
+	}
+	free = free[:position+1]
+	for _, id := range free {
+		name, err := idetcd.claimID(r, id, value, idetcd.currentLease())
+		if err != nil || name != "" {
+			return name, resp.Header.Revision, err
+		}
+	}
+	return "", resp.Header.Revision, nil
+}
+
+//register puts current node into the queues of the roles it can take, a new lease is granted if the previous one has expired.
+func (idetcd *Idetcd) register() error {
+	if err := idetcd.renewLease(); err != nil {
+		return err
+	}
+	for _, r := range idetcd.candidates() {
+		if _, err := idetcd.set(idetcd.waiterKey(r), "", etcdcv3.WithLease(idetcd.currentLease())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//leave removes current node from the queues of the roles it can take.
+func (idetcd *Idetcd) leave() {
+	for _, r := range idetcd.candidates() {
+		idetcd.del(idetcd.waiterKey(r))
+	}
+}
+
+//keepLease keeps the lease of current node alive until ctx is done or the returned function is called.
+func (idetcd *Idetcd) keepLease(ctx context.Context) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	idetcd.keepAlive(ctx, idetcd.currentLease())
+	return cancel
+}
+
+//waiterKey returns the key of current node in the queue of the role.
+func (idetcd *Idetcd) waiterKey(r *role) string {
+	return r.waiterPrefix() + strconv.FormatInt(int64(idetcd.currentLease()), 16)
+}
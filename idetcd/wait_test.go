@@ -0,0 +1,109 @@
+package idetcd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/mholt/caddy"
+)
+
+func TestWaitSlotInOrder(t *testing.T) {
+	//The slots may still be held by the nodes of the tests before.
+	deleteAll()
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit 1
+			when_full wait
+		}`
+	var nodes []*Idetcd
+	for i := 0; i < 3; i++ {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("Could not parse the corefile: %s", err)
+		}
+		if err := idetc.connect(); err != nil {
+			t.Fatalf("Could not connect to etcd: %s", err)
+		}
+		defer idetc.Client.Close()
+		lease, err := idetc.grant()
+		if err != nil {
+			t.Fatalf("Could not grant the lease: %s", err)
+		}
+		idetc.lease = lease.ID
+		nodes = append(nodes, idetc)
+	}
+	if name, err := nodes[0].claimSlot("0", nodes[0].lease); err != nil || name == "" {
+		t.Fatalf("Expected node 0 to take the only slot, got: %q, %v", name, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	promoted := make(chan int, 2)
+	//Node 1 arrives before node 2, so it should be promoted first.
+	for _, i := range []int{1, 2} {
+		go func(i int) {
+			if name := nodes[i].waitSlot(ctx, "value"); name != "" {
+				promoted <- i
+			}
+		}(i)
+		time.Sleep(time.Second)
+	}
+	for _, i := range []int{0, 1} {
+		nodes[i].Client.Revoke(context.TODO(), nodes[i].lease)
+		select {
+		case next := <-promoted:
+			if next != i+1 {
+				t.Errorf("Expected node %d to be promoted, got: node %d", i+1, next)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Expected node %d to be promoted, got none", i+1)
+		}
+	}
+	deleteAll()
+}
+
+func TestWaitSlotMaxWait(t *testing.T) {
+	//The slots may still be held by the nodes of the tests before.
+	deleteAll()
+	corefile := `idetcd {
+			endpoint http://localhost:2379
+			pattern worker{{.ID}}.tf.local.
+			limit 1
+			when_full wait
+			max_wait 2s
+		}`
+	var nodes []*Idetcd
+	for i := 0; i < 2; i++ {
+		idetc, err := idetcdParse(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("Could not parse the corefile: %s", err)
+		}
+		if err := idetc.connect(); err != nil {
+			t.Fatalf("Could not connect to etcd: %s", err)
+		}
+		defer idetc.Client.Close()
+		lease, err := idetc.grant()
+		if err != nil {
+			t.Fatalf("Could not grant the lease: %s", err)
+		}
+		idetc.lease = lease.ID
+		nodes = append(nodes, idetc)
+	}
+	if name, err := nodes[0].claimSlot("0", nodes[0].lease); err != nil || name == "" {
+		t.Fatalf("Expected node 0 to take the only slot, got: %q, %v", name, err)
+	}
+	if name := nodes[1].waitSlot(context.Background(), "1"); name != "" {
+		t.Errorf("Expected node 1 to stop waiting after max_wait, got: %s", name)
+	}
+	resp, err := nodes[1].get(nodes[1].roles[0].waiterPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("Expected to get the waiting nodes, but didn't: %s", err)
+	}
+	if resp.Count != 0 {
+		t.Errorf("Expected node 1 to leave the queue, got %d waiting nodes", resp.Count)
+	}
+	deleteAll()
+}
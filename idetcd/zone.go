@@ -0,0 +1,74 @@
+package idetcd
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+//patternZone returns the zone of the domain name pattern, which is the name after the label containing the id, e.g. tf.local.
+//for worker{{.ID}}.tf.local.
+func patternZone(nameParts [2]string) string {
+	suffix := nameParts[1]
+	i := strings.Index(suffix, ".")
+	if i < 0 || i == len(suffix)-1 {
+		return "."
+	}
+	return dns.Fqdn(suffix[i+1:])
+}
+
+//zone returns the zone which the domain name belongs to, or an empty string if it is not in any of them. The zones are the
+//ones in the Corefile, or the zones of the roles if there is none.
+func (idetcd *Idetcd) zone(name string) string {
+	if len(idetcd.zones) > 0 {
+		return plugin.Zones(idetcd.zones).Matches(name)
+	}
+	zones := make(plugin.Zones, 0, len(idetcd.roles))
+	for _, r := range idetcd.roles {
+		zones = append(zones, r.currentPattern().zone)
+	}
+	return zones.Matches(name)
+}
+
+//soa returns the SOA record of the zone, which is put in the authority section of negative answers. The primary name server is
+//the first member of the zone, or the zone itself while it has no member. The serial is the etcd revision of the last change of
+//the records of the zone which has been seen, so it grows whenever a member joins or leaves and never decreases, and the minimum
+//is the answer ttl, so negative answers are cached as long as positive ones.
+func (idetcd *Idetcd) soa(zone string) (*dns.SOA, error) {
+	var serial int64
+	for _, r := range idetcd.roles {
+		if idetcd.zone(r.currentPattern().zone) != zone {
+			continue
+		}
+		rev, err := idetcd.store.revision(r.slotPrefix())
+		if err != nil {
+			return nil, err
+		}
+		if rev > serial {
+			serial = rev
+		}
+	}
+	var primary string
+	err := idetcd.eachMember(zone, func(name string, key string, record *Record) {
+		if primary == "" {
+			primary = name
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if primary == "" {
+		primary = zone
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: idetcd.answerTTL},
+		Ns:      primary,
+		Mbox:    "hostmaster.dns." + zone,
+		Serial:  uint32(serial),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  idetcd.answerTTL,
+	}, nil
+}